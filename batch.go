@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dewski/pngdiff/cmd/pngdiff"
+)
+
+// Batch limits, override them with BATCH_PARALLELISM, BATCH_MAX_PAIRS,
+// BATCH_REPORT_MAX_PAIRS and BATCH_TIMEOUT. Every pair still waits its turn
+// with the diffLimiter.
+var (
+	batchParallelism = envInt("BATCH_PARALLELISM", 4)
+	batchMaxPairs    = envInt("BATCH_MAX_PAIRS", 1000)
+	batchTimeout     = envDuration("BATCH_TIMEOUT", 10*time.Minute)
+
+	// Reports hold every pair's images in memory until the batch finishes
+	batchReportMaxPairs = envInt("BATCH_REPORT_MAX_PAIRS", 50)
+)
+
+// batchPair is a pair of images to diff, Options holds the same parameters
+// /process accepts in its query string.
+type batchPair struct {
+	Name       string     `json:"name"`
+	BaseURL    string     `json:"base_url"`
+	CompareURL string     `json:"compare_url"`
+	Options    jsonParams `json:"options"`
+}
+
+// jsonParams holds query string parameters sent as a JSON object, any JSON
+// value is accepted and kept as written so 1000000 doesn't become 1e+06.
+type jsonParams map[string]string
+
+func (p *jsonParams) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return err
+	}
+
+	*p = jsonParams{}
+	for key, value := range values {
+		(*p)[key] = fmt.Sprint(value)
+	}
+
+	return nil
+}
+
+// batchResult is the outcome of diffing one pair, either the Result or the
+// error envelope /process would have responded with.
+type batchResult struct {
+	Name       string `json:"name"`
+	BaseURL    string `json:"base_url"`
+	CompareURL string `json:"compare_url"`
+	*pngdiff.Result
+	Error *errorResponse `json:"error,omitempty"`
+
+	// Only set when the batch is reported
+	report *reportPair
+}
+
+// options parses the pair's options, the URLs take precedence over any in
+// Options.
+func (p *batchPair) options() (*pngdiff.Options, error) {
+	params := map[string]string{}
+	maps.Copy(params, p.Options)
+	params["base_url"] = p.BaseURL
+	params["compare_url"] = p.CompareURL
+
+	opts, err := pngdiff.ParseOptions(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return opts, opts.RequirePair()
+}
+
+// accepts reports whether the request's Accept header lists mediaType.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if accepted, _, _ := mime.ParseMediaType(strings.TrimSpace(accept)); accepted == mediaType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wantsNDJSON reports whether the results should be streamed a line at a time
+// as they finish instead of a JSON array in the order they were sent.
+func wantsNDJSON(r *http.Request) bool {
+	return r.URL.Query().Get("stream") == "true" || accepts(r, "application/x-ndjson")
+}
+
+// wantsReport reports whether the results should be an HTML report of the
+// pairs instead of JSON.
+func wantsReport(r *http.Request) bool {
+	return r.URL.Query().Get("report") == "true" || accepts(r, "text/html")
+}
+
+// handleBatch diffs a JSON array of pairs, up to batchParallelism at a time,
+// responding with a result or error for every pair.
+func handleBatch(rw http.ResponseWriter, r *http.Request) {
+	log := logFor(r)
+
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		renderError(rw, r, errMethodNotAllowed)
+		return
+	}
+
+	var pairs []*batchPair
+	r.Body = http.MaxBytesReader(rw, r.Body, maxUploadSize)
+	if err := json.NewDecoder(r.Body).Decode(&pairs); err != nil {
+		if err = uploadError(err); !errors.Is(err, errUploadTooLarge) {
+			err = &pngdiff.OptionError{Param: "body", Message: "must be a JSON array of pairs"}
+		}
+		renderError(rw, r, err)
+		return
+	}
+
+	if len(pairs) == 0 || int64(len(pairs)) > batchMaxPairs {
+		renderError(rw, r, &pngdiff.OptionError{
+			Param:   "body",
+			Message: fmt.Sprintf("must have between 1 and %d pairs", batchMaxPairs),
+		})
+		return
+	}
+
+	for _, pair := range pairs {
+		if pair == nil {
+			renderError(rw, r, &pngdiff.OptionError{Param: "body", Message: "must only have JSON objects as pairs"})
+			return
+		}
+	}
+	log.Add("pairs", len(pairs))
+
+	report := wantsReport(r)
+	if report && int64(len(pairs)) > batchReportMaxPairs {
+		renderError(rw, r, &pngdiff.OptionError{
+			Param:   "body",
+			Message: fmt.Sprintf("must have at most %d pairs for a report", batchReportMaxPairs),
+		})
+		return
+	}
+
+	// Batches take longer than the server's write timeout allows
+	http.NewResponseController(rw).SetWriteDeadline(time.Now().Add(batchTimeout))
+	ctx, cancel := context.WithTimeout(r.Context(), batchTimeout)
+	defer cancel()
+
+	stream := !report && wantsNDJSON(r)
+	results := make([]*batchResult, len(pairs))
+	finished := make(chan *batchResult)
+
+	go func() {
+		var wg sync.WaitGroup
+		workers := make(chan struct{}, batchParallelism)
+
+		for i, pair := range pairs {
+			i, pair := i, pair
+
+			wg.Add(1)
+			workers <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-workers }()
+				defer func() { finished <- results[i] }()
+
+				// net/http only recovers panics in the handler's goroutine, fail
+				// the pair instead of the whole server
+				defer func() {
+					if v := recover(); v != nil {
+						log.logger.Error("pair panicked", "pair", pair.Name, "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+						results[i] = failedBatchPair(pair, fmt.Errorf("diffing the pair panicked: %v", v))
+					}
+				}()
+
+				results[i] = diffBatchPair(ctx, log, pair, report)
+			}()
+		}
+
+		wg.Wait()
+		close(finished)
+	}()
+
+	var encoder *json.Encoder
+	if stream {
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+		rw.WriteHeader(http.StatusOK)
+		encoder = json.NewEncoder(rw)
+	}
+
+	failed := 0
+	for result := range finished {
+		if result.Error != nil {
+			failed++
+		}
+
+		if stream {
+			encoder.Encode(result)
+			http.NewResponseController(rw).Flush()
+		}
+	}
+	log.Add("failed", failed)
+
+	switch {
+	case report:
+		renderReport(rw, r, results)
+	case !stream:
+		renderJSON(rw, http.StatusOK, results)
+	}
+}
+
+// renderReport responds with an HTML report of the batch.
+func renderReport(rw http.ResponseWriter, r *http.Request, results []*batchResult) {
+	pairs := make([]*reportPair, len(results))
+	for i, result := range results {
+		pair := result.report
+		if pair == nil {
+			pair = &reportPair{}
+		}
+		pair.Name = result.name()
+		pair.Result = result.Result
+
+		if result.Error != nil {
+			pair.Status = fileFailed
+			pair.Error = result.Error.Message
+		} else {
+			pair.Status = resultStatus(result.Result)
+		}
+		pairs[i] = pair
+	}
+
+	var buf bytes.Buffer
+	if err := writeReport(&buf, fmt.Sprintf("Batch of %d pairs", len(pairs)), pairs); err != nil {
+		renderError(rw, r, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf.Bytes())
+}
+
+// name identifies the pair in a report, its URLs when it wasn't named.
+func (r *batchResult) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+
+	return r.BaseURL + " compared to " + r.CompareURL
+}
+
+// diffBatchPair diffs a pair through the same path as /process, also
+// rendering it for an HTML report when report is set.
+func diffBatchPair(ctx context.Context, log *requestLog, pair *batchPair, report bool) *batchResult {
+	result := &batchResult{
+		Name:       pair.Name,
+		BaseURL:    pair.BaseURL,
+		CompareURL: pair.CompareURL,
+	}
+
+	opts, err := pair.options()
+	if err == nil {
+		opts.Logger = log.logger.With("pair", pair.Name)
+		opts.Cache = imageCache
+		opts.OnDownload = recordDownload
+
+		if report {
+			result.Result, result.report, err = diffPairReport(ctx, opts)
+		} else {
+			result.Result, err = diffPair(ctx, opts)
+		}
+	}
+
+	if err != nil {
+		return failedBatchPair(pair, err)
+	}
+
+	return result
+}
+
+// failedBatchPair is the result of a pair which failed with err.
+func failedBatchPair(pair *batchPair, err error) *batchResult {
+	_, response := newErrorResponse(err)
+
+	return &batchResult{
+		Name:       pair.Name,
+		BaseURL:    pair.BaseURL,
+		CompareURL: pair.CompareURL,
+		Error:      &response,
+	}
+}
+
+// diffPairReport diffs the pair like diffPair, then renders its images and the
+// regions which changed for the report.
+func diffPairReport(ctx context.Context, opts *pngdiff.Options) (*pngdiff.Result, *reportPair, error) {
+	downloadCtx, cancel := context.WithTimeout(ctx, downloadTimeout)
+	defer cancel()
+
+	baseImage, compareImage, err := loadPair(downloadCtx, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Rendering the report is as heavy as the diff, hold the limiter for both
+	release, err := acquireDiff(ctx, opts, baseImage, compareImage)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	key, result := storedResult(ctx, opts)
+	if result == nil {
+		if result, err = runDiff(ctx, opts, key, baseImage, compareImage); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	pair, err := newReportPair(baseImage, compareImage, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return result, pair, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchPairPanics(t *testing.T) {
+	upstream := newUpstream(t)
+
+	// Diff reads rows of compare past its height when base is taller
+	body := `[
+		{"name": "mismatched", "base_url": "` + upstream.URL + `/tall.png", "compare_url": "` + upstream.URL + `/image.png"},
+		{"name": "same", "base_url": "` + upstream.URL + `/image.png", "compare_url": "` + upstream.URL + `/image.png"}
+	]`
+
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+	withLogging("batch", handleBatch)(rw, r)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status is %d, want %d", rw.Code, http.StatusOK)
+	}
+
+	var results []*batchResult
+	if err := json.Unmarshal(rw.Body.Bytes(), &results); err != nil {
+		t.Fatalf("response isn't valid JSON: %s\n%s", err, rw.Body)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+
+	if results[0].Error == nil || results[0].Error.Code != "internal_error" {
+		t.Errorf("mismatched pair error is %+v, want internal_error", results[0].Error)
+	}
+	if results[1].Error != nil || results[1].Result == nil {
+		t.Errorf("same pair failed with %+v", results[1].Error)
+	}
+}
+
+func TestJSONParams(t *testing.T) {
+	var params jsonParams
+	if err := json.Unmarshal([]byte(`{"max_area": 1000000, "nested": true, "group": "lines"}`), &params); err != nil {
+		t.Fatal(err)
+	}
+
+	want := jsonParams{"max_area": "1000000", "nested": "true", "group": "lines"}
+	for key, value := range want {
+		if params[key] != value {
+			t.Errorf("%s is %q, want %q", key, params[key], value)
+		}
+	}
+
+	if err := json.Unmarshal([]byte(`[1]`), &params); err == nil {
+		t.Error("decoded an array as params")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/dewski/pngdiff/cmd/pngdiff"
+)
+
+// runCLI diffs two images or two directories of images, or detects the
+// regions in one image, printing the result to stdout. It returns the process
+// exit code.
+func runCLI(args []string) int {
+	flags := flag.NewFlagSet("pngdiff", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: pngdiff [flags] base.png compare.png")
+		fmt.Fprintln(flags.Output(), "       pngdiff [flags] base/ compare/")
+		fmt.Fprintln(flags.Output(), "       pngdiff [flags] image.png")
+		flags.PrintDefaults()
+	}
+
+	out := flags.String("o", "", "write annotated or labels output to this file instead of stdout, or diff images to this directory when comparing directories")
+	parallelism := flags.Int("parallelism", runtime.NumCPU(), "number of pairs to diff at a time when comparing directories")
+	report := flags.String("report", "", "write an HTML report to this file when comparing directories")
+	threshold := flags.Float64("threshold", 0, "exit with status 1 when a pair changed by more than this percentage when comparing directories, added and removed files count as 100")
+	for _, param := range pngdiff.Params {
+		flags.String(param.Name, "", param.Usage)
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	params := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		params[f.Name] = f.Value.String()
+	})
+
+	switch flags.NArg() {
+	case 1:
+		params["image_url"] = flags.Arg(0)
+	case 2:
+		params["base_url"] = flags.Arg(0)
+		params["compare_url"] = flags.Arg(1)
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	opts, err := pngdiff.ParseOptions(params)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if flags.NArg() == 2 && isDir(flags.Arg(0)) && isDir(flags.Arg(1)) {
+		if *parallelism < 1 {
+			fmt.Fprintln(os.Stderr, "parallelism must be at least 1")
+			return 2
+		}
+
+		return cliDirs(&dirComparison{
+			baseDir:     flags.Arg(0),
+			compareDir:  flags.Arg(1),
+			out:         *out,
+			parallelism: *parallelism,
+			report:      *report != "",
+			opts:        opts,
+		}, *report, *threshold)
+	}
+
+	if flags.NArg() == 2 {
+		err = cliDiff(opts)
+	} else {
+		err = cliBounds(opts, *out)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func cliDiff(opts *pngdiff.Options) error {
+	if err := opts.RequirePair(); err != nil {
+		return err
+	}
+
+	baseImage, err := pngdiff.DownloadImage(opts.BaseURL)
+	if err != nil {
+		return fmt.Errorf("could not load %s: %s", opts.BaseURL, err)
+	}
+
+	compareImage, err := pngdiff.DownloadImage(opts.CompareURL)
+	if err != nil {
+		return fmt.Errorf("could not load %s: %s", opts.CompareURL, err)
+	}
+
+	additions, deletions, diffs, changes, err := pngdiff.Diff(baseImage, compareImage)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(pngdiff.Result{
+		Additions: additions,
+		Deletions: deletions,
+		Diffs:     diffs,
+		Changes:   changes,
+	})
+}
+
+// cliDirs compares two directories, writing an HTML report to reportPath
+// when it isn't empty. It fails when any pair couldn't be diffed or changed by
+// more than threshold percent, files which were added or removed count as
+// 100% changed.
+func cliDirs(comparison *dirComparison, reportPath string, threshold float64) int {
+	report, err := comparison.run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if reportPath != "" {
+		title := fmt.Sprintf("%s compared to %s", comparison.baseDir, comparison.compareDir)
+		if err := writeReportFile(reportPath, title, report.reportPairs()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	status := 0
+	for _, file := range report.Files {
+		switch {
+		case file.Status == fileFailed:
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file.Path, file.Error)
+			status = 1
+		case file.Status == fileChanged && file.Changes > threshold:
+			fmt.Fprintf(os.Stderr, "%s: changed %.2f%%\n", file.Path, file.Changes)
+			status = 1
+		case (file.Status == fileAdded || file.Status == fileRemoved) && threshold < 100:
+			// A file only in one directory changed entirely
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file.Path, file.Status)
+			status = 1
+		}
+	}
+
+	return status
+}
+
+func cliBounds(opts *pngdiff.Options, out string) error {
+	if err := opts.RequireImage(); err != nil {
+		return err
+	}
+
+	image, compareImage, err := opts.LoadBoundsImages(context.Background())
+	if err != nil {
+		return err
+	}
+
+	regions, annotateImage, err := opts.DetectBounds(image, compareImage)
+	if err != nil {
+		return err
+	}
+
+	if opts.Output == pngdiff.OutputJSON {
+		return json.NewEncoder(os.Stdout).Encode(regions)
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		file, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	return png.Encode(w, pngdiff.RenderRegions(annotateImage, regions, opts.Output))
+}
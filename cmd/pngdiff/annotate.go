@@ -0,0 +1,198 @@
+package pngdiff
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+)
+
+// Output formats for region detection results.
+const (
+	OutputJSON      = "json"
+	OutputAnnotated = "annotated"
+	OutputLabels    = "labels"
+)
+
+// digitGlyphs is a 3x5 bitmap font for region indexes, each row is 3 bits
+// with the most significant bit on the left.
+var digitGlyphs = [10][5]uint8{
+	{7, 5, 5, 5, 7}, // 0
+	{2, 6, 2, 2, 7}, // 1
+	{7, 1, 7, 4, 7}, // 2
+	{7, 1, 7, 1, 7}, // 3
+	{5, 5, 7, 1, 1}, // 4
+	{7, 4, 7, 1, 7}, // 5
+	{7, 4, 7, 5, 7}, // 6
+	{7, 1, 1, 1, 1}, // 7
+	{7, 5, 7, 5, 7}, // 8
+	{7, 5, 7, 1, 7}, // 9
+}
+
+// labelColor picks a distinct, fully opaque color for the nth region by
+// stepping around the hue wheel by the golden angle.
+func labelColor(n int) color.NRGBA {
+	hue := math.Mod(float64(n)*137.508, 360) / 60
+	x := uint8(255 * (1 - math.Abs(math.Mod(hue, 2)-1)))
+
+	switch int(hue) {
+	case 0:
+		return color.NRGBA{255, x, 0, 255}
+	case 1:
+		return color.NRGBA{x, 255, 0, 255}
+	case 2:
+		return color.NRGBA{0, 255, x, 255}
+	case 3:
+		return color.NRGBA{0, x, 255, 255}
+	case 4:
+		return color.NRGBA{x, 0, 255, 255}
+	default:
+		return color.NRGBA{255, 0, x, 255}
+	}
+}
+
+// AnnotateRegions returns a copy of img with every region outlined and
+// labelled with its index in regions.
+func AnnotateRegions(img image.Image, regions []*Region) *image.NRGBA {
+	bounds := img.Bounds()
+	annotated := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(annotated, annotated.Bounds(), img, bounds.Min, draw.Src)
+
+	for i, r := range regions {
+		c := labelColor(i)
+		rect := r.Rectangle()
+
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			annotated.SetNRGBA(x, rect.Min.Y, c)
+			annotated.SetNRGBA(x, rect.Max.Y-1, c)
+		}
+
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			annotated.SetNRGBA(rect.Min.X, y, c)
+			annotated.SetNRGBA(rect.Max.X-1, y, c)
+		}
+
+		drawIndex(annotated, i, rect.Min, c)
+	}
+
+	return annotated
+}
+
+// drawIndex writes n in white on a tag of color c, above the point when there
+// is room and inside of the region otherwise.
+func drawIndex(img *image.NRGBA, n int, at image.Point, c color.NRGBA) {
+	digits := strconv.Itoa(n)
+	tag := image.Rect(0, 0, len(digits)*4+1, 7).Add(at)
+	if tag.Min.Y-tag.Dy() >= img.Bounds().Min.Y {
+		tag = tag.Sub(image.Pt(0, tag.Dy()))
+	}
+
+	draw.Draw(img, tag, &image.Uniform{c}, image.Point{}, draw.Src)
+
+	white := color.NRGBA{255, 255, 255, 255}
+	for i, digit := range digits {
+		glyph := digitGlyphs[digit-'0']
+
+		for row := 0; row < 5; row++ {
+			for col := 0; col < 3; col++ {
+				if glyph[row]&(4>>uint(col)) != 0 {
+					img.SetNRGBA(tag.Min.X+1+i*4+col, tag.Min.Y+1+row, white)
+				}
+			}
+		}
+	}
+}
+
+// LabelMap returns a false color image the size of bounds where the pixels of
+// every region are painted a distinct color and everything else is
+// transparent.
+func LabelMap(bounds image.Rectangle, regions []*Region) *image.NRGBA {
+	labels := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	for i, r := range regions {
+		c := labelColor(i)
+		rect := r.Rectangle().Intersect(labels.Bounds())
+
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				if r.Contains(x, y) {
+					labels.SetNRGBA(x, y, c)
+				}
+			}
+		}
+	}
+
+	return labels
+}
+
+// ParseOutput reads the output parameter, defaulting to OutputJSON.
+func ParseOutput(params map[string]string) (string, error) {
+	switch output := params["output"]; output {
+	case "":
+		return OutputJSON, nil
+	case OutputJSON, OutputAnnotated, OutputLabels:
+		return output, nil
+	default:
+		return "", &OptionError{Param: "output", Message: "must be json, annotated or labels"}
+	}
+}
+
+// RenderRegions draws regions on img for the OutputAnnotated and OutputLabels
+// formats.
+func RenderRegions(img image.Image, regions []*Region, output string) image.Image {
+	if output == OutputLabels {
+		return LabelMap(img.Bounds(), regions)
+	}
+
+	return AnnotateRegions(img, regions)
+}
+
+// Colors DiffImage highlights pixels with.
+var (
+	diffAdded    = color.NRGBA{0, 200, 0, 255}
+	diffRemoved  = color.NRGBA{220, 0, 0, 255}
+	diffModified = color.NRGBA{255, 0, 255, 255}
+)
+
+// DiffImage returns an image large enough for both images showing a faded
+// copy of compareImage with every pixel that differs from baseImage
+// highlighted. Pixels only inside compareImage are green, pixels only inside
+// baseImage are red and pixels that changed are magenta.
+func DiffImage(baseImage, compareImage image.Image) *image.NRGBA {
+	baseBounds := image.Rect(0, 0, baseImage.Bounds().Dx(), baseImage.Bounds().Dy())
+	compareBounds := image.Rect(0, 0, compareImage.Bounds().Dx(), compareImage.Bounds().Dy())
+	diff := image.NewNRGBA(baseBounds.Union(compareBounds))
+
+	for y := 0; y < diff.Rect.Dy(); y++ {
+		for x := 0; x < diff.Rect.Dx(); x++ {
+			point := image.Pt(x, y)
+			inBase, inCompare := point.In(baseBounds), point.In(compareBounds)
+
+			switch {
+			case !inBase:
+				diff.SetNRGBA(x, y, diffAdded)
+			case !inCompare:
+				diff.SetNRGBA(x, y, diffRemoved)
+			case !samePixel(pixelAt(baseImage, x, y), pixelAt(compareImage, x, y)):
+				diff.SetNRGBA(x, y, diffModified)
+			default:
+				diff.SetNRGBA(x, y, fade(pixelAt(compareImage, x, y)))
+			}
+		}
+	}
+
+	return diff
+}
+
+// fade blends the pixel over white so highlights stand out against it.
+func fade(pixel color.Color) color.NRGBA {
+	c := color.NRGBAModel.Convert(pixel).(color.NRGBA)
+	blend := func(v uint8) uint8 {
+		// Transparent pixels fade to white too
+		v = uint8(255 - (255-int(v))*int(c.A)/255)
+		return uint8(255 - (255-int(v))/4)
+	}
+
+	return color.NRGBA{blend(c.R), blend(c.G), blend(c.B), 255}
+}
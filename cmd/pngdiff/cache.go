@@ -0,0 +1,215 @@
+package pngdiff
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"image"
+	"log/slog"
+	"sync"
+)
+
+// ImageCache keeps decoded images in memory, evicting the least recently used
+// once they take more than its byte budget. Images are found by the SHA-256 of
+// their PNG bytes, and by the URL they were downloaded from after revalidating
+// it with its ETag or Last-Modified. A nil *ImageCache caches nothing.
+//
+// Cached images are shared between callers and must not be modified.
+type ImageCache struct {
+	maxBytes int64
+
+	mu     sync.Mutex
+	bytes  int64
+	lru    list.List
+	byHash map[[sha256.Size]byte]*list.Element
+	byURL  map[string]*cachedURL
+	hits   int64
+	misses int64
+}
+
+type cachedImage struct {
+	hash [sha256.Size]byte
+	img  image.Image
+	size int64
+	urls []string
+}
+
+// cachedURL remembers the validators of the response an image came from.
+type cachedURL struct {
+	hash         [sha256.Size]byte
+	etag         string
+	lastModified string
+}
+
+// CacheStats counts how often an ImageCache had the image asked for.
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+	Images int
+	Bytes  int64
+}
+
+// Attr groups the stats for a log record.
+func (s CacheStats) Attr() slog.Attr {
+	return slog.Group("cache",
+		"hits", s.Hits,
+		"misses", s.Misses,
+		"images", s.Images,
+		"bytes", s.Bytes,
+	)
+}
+
+// NewImageCache creates a cache holding up to maxBytes of decoded pixels.
+func NewImageCache(maxBytes int64) *ImageCache {
+	return &ImageCache{
+		maxBytes: maxBytes,
+		byHash:   map[[sha256.Size]byte]*list.Element{},
+		byURL:    map[string]*cachedURL{},
+	}
+}
+
+// Stats returns the hits and misses so far and how full the cache is.
+func (c *ImageCache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Hits:   c.hits,
+		Misses: c.misses,
+		Images: c.lru.Len(),
+		Bytes:  c.bytes,
+	}
+}
+
+// validators returns the ETag and Last-Modified to revalidate url with, ok is
+// false when its image isn't cached.
+func (c *ImageCache) validators(url string) (etag, lastModified string, ok bool) {
+	if c == nil {
+		return "", "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, found := c.byURL[url]
+	if !found {
+		return "", "", false
+	}
+
+	return cached.etag, cached.lastModified, true
+}
+
+// revalidated returns the image cached for url and its hash once the server
+// confirmed it hasn't changed, nil if it was evicted in the meantime.
+func (c *ImageCache) revalidated(url string) (image.Image, [sha256.Size]byte) {
+	if c == nil {
+		return nil, [sha256.Size]byte{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, found := c.byURL[url]
+	if !found {
+		return nil, [sha256.Size]byte{}
+	}
+
+	elem := c.byHash[cached.hash]
+	c.lru.MoveToFront(elem)
+	c.hits++
+
+	return elem.Value.(*cachedImage).img, cached.hash
+}
+
+// get returns the image with the hash, also remembering it as the content of
+// url when url isn't empty.
+func (c *ImageCache) get(hash [sha256.Size]byte, url, etag, lastModified string) image.Image {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.byHash[hash]
+	if !found {
+		c.misses++
+		return nil
+	}
+
+	c.lru.MoveToFront(elem)
+	c.hits++
+
+	entry := elem.Value.(*cachedImage)
+	c.remember(entry, url, etag, lastModified)
+
+	return entry.img
+}
+
+// add caches the decoded image, evicting the least recently used images to
+// stay within budget. Images larger than the whole budget aren't cached.
+func (c *ImageCache) add(hash [sha256.Size]byte, img *image.NRGBA, url, etag, lastModified string) {
+	if c == nil {
+		return
+	}
+
+	size := int64(len(img.Pix))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Decoded by someone else at the same time
+	if elem, found := c.byHash[hash]; found {
+		c.remember(elem.Value.(*cachedImage), url, etag, lastModified)
+		return
+	}
+
+	entry := &cachedImage{hash: hash, img: img, size: size}
+	c.byHash[hash] = c.lru.PushFront(entry)
+	c.bytes += size
+	c.remember(entry, url, etag, lastModified)
+
+	for c.bytes > c.maxBytes {
+		c.evict(c.lru.Back())
+	}
+}
+
+// remember points url at the entry, only URLs with a validator can be
+// revalidated later.
+func (c *ImageCache) remember(entry *cachedImage, url, etag, lastModified string) {
+	if url == "" {
+		return
+	}
+
+	if etag == "" && lastModified == "" {
+		delete(c.byURL, url)
+		return
+	}
+
+	c.byURL[url] = &cachedURL{hash: entry.hash, etag: etag, lastModified: lastModified}
+	for _, known := range entry.urls {
+		if known == url {
+			return
+		}
+	}
+	entry.urls = append(entry.urls, url)
+}
+
+func (c *ImageCache) evict(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cachedImage)
+	delete(c.byHash, entry.hash)
+	c.bytes -= entry.size
+
+	for _, url := range entry.urls {
+		// The URL may have been pointed at newer content since
+		if cached, found := c.byURL[url]; found && cached.hash == entry.hash {
+			delete(c.byURL, url)
+		}
+	}
+}
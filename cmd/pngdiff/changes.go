@@ -0,0 +1,156 @@
+package pngdiff
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Kinds of change reported on a Region by DetectChanges.
+const (
+	// ChangeAdded means the region is only present in the compare image.
+	ChangeAdded = "added"
+	// ChangeRemoved means the region is only present in the base image.
+	ChangeRemoved = "removed"
+	// ChangeModified means the region is present in both images but differs.
+	ChangeModified = "modified"
+)
+
+// backgroundColor is opts.Background when set, otherwise the most common
+// color along the image's border is taken as the color of the empty canvas,
+// so content in a corner such as a logo or a dark navbar isn't mistaken for
+// it.
+func backgroundColor(img image.Image, opts *RegionOptions) color.Color {
+	if opts.Background != nil {
+		return opts.Background
+	}
+
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return color.NRGBA{0, 0, 0, 0}
+	}
+
+	colors := map[color.NRGBA]int{}
+	count := func(x, y int) {
+		colors[color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)]++
+	}
+
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		count(x, bounds.Min.Y)
+		if bounds.Dy() > 1 {
+			count(x, bounds.Max.Y-1)
+		}
+	}
+	for y := bounds.Min.Y + 1; y < bounds.Max.Y-1; y++ {
+		count(bounds.Min.X, y)
+		if bounds.Dx() > 1 {
+			count(bounds.Max.X-1, y)
+		}
+	}
+
+	return dominantColor(colors)
+}
+
+// pixelAt returns the pixel at x, y or an empty pixel when the point is
+// outside of the image.
+func pixelAt(img image.Image, x, y int) color.Color {
+	point := image.Pt(img.Bounds().Min.X+x, img.Bounds().Min.Y+y)
+	if !point.In(img.Bounds()) {
+		return color.NRGBA{0, 0, 0, 0}
+	}
+
+	return img.At(point.X, point.Y)
+}
+
+// contentPixel reports whether the pixel is part of the image's content
+// rather than its transparent or background canvas.
+func contentPixel(pixel, background color.Color, opts *RegionOptions) bool {
+	return opts.visible(color.NRGBAModel.Convert(pixel).(color.NRGBA)) &&
+		!samePixel(pixel, background)
+}
+
+// DetectChanges finds the regions that differ between baseImage and
+// compareImage. Each region is classified as added when its pixels only have
+// content in the compare image, removed when they only have content in the
+// base image and modified otherwise.
+func DetectChanges(baseImage, compareImage image.Image, opts *RegionOptions) (regions []*Region, err error) {
+	if opts == nil {
+		opts = DefaultRegionOptions()
+	}
+
+	width := int(math.Max(float64(baseImage.Bounds().Dx()), float64(compareImage.Bounds().Dx())))
+	height := maxHeight(baseImage, compareImage)
+
+	baseBackground := backgroundColor(baseImage, opts)
+	compareBackground := backgroundColor(compareImage, opts)
+
+	changes := make([][]string, height)
+	changed := make([][]bool, height)
+	for y := 0; y < height; y++ {
+		changes[y] = make([]string, width)
+		changed[y] = make([]bool, width)
+
+		for x := 0; x < width; x++ {
+			basePixel := pixelAt(baseImage, x, y)
+			comparePixel := pixelAt(compareImage, x, y)
+			if opts.ignored(x, y) || samePixel(basePixel, comparePixel) {
+				continue
+			}
+
+			changed[y][x] = true
+			inBase := contentPixel(basePixel, baseBackground, opts)
+			inCompare := contentPixel(comparePixel, compareBackground, opts)
+
+			switch {
+			case inCompare && !inBase:
+				changes[y][x] = ChangeAdded
+			case inBase && !inCompare:
+				changes[y][x] = ChangeRemoved
+			default:
+				changes[y][x] = ChangeModified
+			}
+		}
+	}
+
+	blobMap, blobs := labelRegions(changed, opts)
+
+	counts := map[int]map[string]int{}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			label := blobMap[y][x]
+			if label <= 0 {
+				continue
+			}
+
+			if counts[label] == nil {
+				counts[label] = map[string]int{}
+			}
+			counts[label][changes[y][x]]++
+		}
+	}
+
+	for label, r := range blobs {
+		count := counts[label]
+
+		label := label
+		r.inRegion = func(x, y int) bool {
+			return y >= 0 && y < height && x >= 0 && x < width && blobMap[y][x] == label
+		}
+
+		switch r.Pixels {
+		case count[ChangeAdded]:
+			r.Change = ChangeAdded
+		case count[ChangeRemoved]:
+			r.Change = ChangeRemoved
+		default:
+			r.Change = ChangeModified
+		}
+
+		r.Percentage = (float64(r.Pixels) / float64(r.Area())) * 100
+
+		regions = append(regions, r)
+	}
+	regions = opts.filter(regions)
+
+	return
+}
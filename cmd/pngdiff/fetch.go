@@ -0,0 +1,269 @@
+package pngdiff
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ErrDecode is returned when an image isn't a valid PNG.
+var ErrDecode = errors.New("couldn't decode the PNG")
+
+// FetchError is returned when an image couldn't be downloaded.
+type FetchError struct {
+	URL string
+	// StatusCode is the upstream response status, 0 when it never responded
+	StatusCode int
+	Err        error
+}
+
+func (e *FetchError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("couldn't download %s: status %d", e.URL, e.StatusCode)
+	}
+
+	return fmt.Sprintf("couldn't download %s: %s", e.URL, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the download was cancelled for taking too long.
+func (e *FetchError) Timeout() bool {
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// ImageError ties an error loading an image to the parameter it came from.
+type ImageError struct {
+	Param string
+	Err   error
+}
+
+func (e *ImageError) Error() string {
+	return e.Param + ": " + e.Err.Error()
+}
+
+func (e *ImageError) Unwrap() error {
+	return e.Err
+}
+
+// Fetcher loads images from disk or downloads them.
+type Fetcher struct {
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+
+	// Logger defaults to slog.Default()
+	Logger *slog.Logger
+
+	// Cache reuses images downloaded or decoded before, nil disables it
+	Cache *ImageCache
+
+	// OnDownload is called with the size of every image downloaded and how
+	// long it took, for metrics.
+	OnDownload func(url string, size int, took time.Duration)
+}
+
+// fetchTiming splits how long fetching an image took.
+type fetchTiming struct {
+	download time.Duration
+	decode   time.Duration
+}
+
+func (f *Fetcher) client() *http.Client {
+	if f.Client != nil {
+		return f.Client
+	}
+
+	return http.DefaultClient
+}
+
+func (f *Fetcher) logger() *slog.Logger {
+	if f.Logger != nil {
+		return f.Logger
+	}
+
+	return slog.Default()
+}
+
+// response is a downloaded image, or the cached image when the server said
+// it hasn't changed.
+type response struct {
+	body         []byte
+	etag         string
+	lastModified string
+	cached       image.Image
+	hash         [sha256.Size]byte
+}
+
+func (f *Fetcher) download(ctx context.Context, url string, revalidate bool) (*response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, &FetchError{URL: url, Err: err}
+	}
+
+	if revalidate {
+		if etag, lastModified, ok := f.Cache.validators(url); ok {
+			if etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				req.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+
+	resp, err := f.client().Do(req)
+	if err != nil {
+		return nil, &FetchError{URL: url, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if revalidate && resp.StatusCode == http.StatusNotModified {
+		if img, hash := f.Cache.revalidated(url); img != nil {
+			return &response{cached: img, hash: hash}, nil
+		}
+
+		// Evicted since asking, download it again
+		return f.download(ctx, url, false)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &FetchError{URL: url, StatusCode: resp.StatusCode}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &FetchError{URL: url, Err: err}
+	}
+
+	return &response{
+		body:         body,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		hash:         sha256.Sum256(body),
+	}, nil
+}
+
+// DecodeImage decodes a PNG, used for both downloaded and uploaded images
+func DecodeImage(r io.Reader) (image.Image, error) {
+	loadedImage, err := png.Decode(r)
+	if err != nil {
+		return nil, ErrDecode
+	}
+
+	// Diff works directly on NRGBA pixels
+	if _, ok := loadedImage.(*image.NRGBA); !ok {
+		nrgba := image.NewNRGBA(loadedImage.Bounds())
+		draw.Draw(nrgba, nrgba.Bounds(), loadedImage, loadedImage.Bounds().Min, draw.Src)
+		loadedImage = nrgba
+	}
+
+	return loadedImage, nil
+}
+
+// Fetch loads the image from disk or downloads it from url. Download failures
+// are returned as a *FetchError and invalid images as ErrDecode.
+func (f *Fetcher) Fetch(ctx context.Context, url string) (image.Image, error) {
+	img, _, _, err := f.fetch(ctx, url)
+	return img, err
+}
+
+// fetch also returns the hex SHA-256 of the image's PNG bytes.
+func (f *Fetcher) fetch(ctx context.Context, url string) (img image.Image, hash string, timing fetchTiming, err error) {
+	var resp *response
+
+	// Load the image from disk if it's available
+	if info, statErr := os.Stat(url); statErr == nil && !info.IsDir() {
+		body, readErr := ioutil.ReadFile(url)
+		if readErr != nil {
+			return nil, "", timing, errors.New("couldn't load the file")
+		}
+		resp = &response{body: body, hash: sha256.Sum256(body)}
+	} else {
+		start := time.Now()
+		resp, err = f.download(ctx, url, true)
+		timing.download = time.Since(start)
+		if err != nil {
+			return
+		}
+
+		if resp.cached != nil {
+			f.log(url, resp, "not_modified")
+			return resp.cached, hex.EncodeToString(resp.hash[:]), timing, nil
+		}
+
+		if f.OnDownload != nil {
+			f.OnDownload(url, len(resp.body), timing.download)
+		}
+	}
+
+	start := time.Now()
+	img, result, err := f.decode(url, resp)
+	timing.decode = time.Since(start)
+	if err != nil {
+		return
+	}
+	f.log(url, resp, result)
+
+	return img, hex.EncodeToString(resp.hash[:]), timing, nil
+}
+
+// decode returns the cached image with the same content or decodes it,
+// result is whether it was a cache hit or miss.
+func (f *Fetcher) decode(url string, resp *response) (img image.Image, result string, err error) {
+	if f.Cache == nil {
+		img, err = DecodeImage(bytes.NewReader(resp.body))
+		return img, "", err
+	}
+
+	if img := f.Cache.get(resp.hash, url, resp.etag, resp.lastModified); img != nil {
+		return img, "hit", nil
+	}
+
+	img, err = DecodeImage(bytes.NewReader(resp.body))
+	if err != nil {
+		return nil, "miss", err
+	}
+	f.Cache.add(resp.hash, img.(*image.NRGBA), url, resp.etag, resp.lastModified)
+
+	return img, "miss", nil
+}
+
+func (f *Fetcher) log(url string, resp *response, result string) {
+	args := []any{"url", url, "bytes", len(resp.body)}
+	if f.Cache != nil {
+		args = append(args, "cache_result", result, f.Cache.Stats().Attr())
+	}
+
+	f.logger().Info("loaded image", args...)
+}
+
+// DownloadImage loads an image from disk or downloads it from URL
+func DownloadImage(url string) (image.Image, error) {
+	return DownloadImageContext(context.Background(), url)
+}
+
+// DownloadImageContext is DownloadImage with a context to cancel or time out
+// the download.
+func DownloadImageContext(ctx context.Context, url string) (image.Image, error) {
+	return (&Fetcher{}).Fetch(ctx, url)
+}
@@ -0,0 +1,165 @@
+package pngdiff
+
+import (
+	"strconv"
+)
+
+// Layout levels GroupRegions can merge regions into, each level is built from
+// the one before it.
+const (
+	GroupWords  = "words"
+	GroupLines  = "lines"
+	GroupBlocks = "blocks"
+)
+
+// GroupOptions controls how GroupRegions merges nearby regions.
+type GroupOptions struct {
+	// Level is one of GroupWords, GroupLines or GroupBlocks, empty disables
+	// grouping.
+	Level string
+
+	// WordGap is the widest horizontal gap between glyphs of the same word.
+	WordGap int
+
+	// LineGap is the widest horizontal gap between words on the same line.
+	LineGap int
+
+	// BlockGap is the tallest vertical gap between lines of the same block.
+	BlockGap int
+}
+
+// DefaultGroupOptions returns gaps which suit regular sized screen text.
+func DefaultGroupOptions() *GroupOptions {
+	return &GroupOptions{
+		WordGap:  3,
+		LineGap:  10,
+		BlockGap: 6,
+	}
+}
+
+// ParseGroupOptions builds GroupOptions from request parameters, falling back
+// to DefaultGroupOptions for anything missing.
+func ParseGroupOptions(params map[string]string) (*GroupOptions, error) {
+	opts := DefaultGroupOptions()
+
+	switch level := params["group"]; level {
+	case "", GroupWords, GroupLines, GroupBlocks:
+		opts.Level = level
+	default:
+		return nil, &OptionError{Param: "group", Message: "must be words, lines or blocks"}
+	}
+
+	gaps := map[string]*int{
+		"word_gap":  &opts.WordGap,
+		"line_gap":  &opts.LineGap,
+		"block_gap": &opts.BlockGap,
+	}
+	for param, gap := range gaps {
+		v := params[param]
+		if v == "" {
+			continue
+		}
+
+		value, err := strconv.Atoi(v)
+		if err != nil || value < 0 {
+			return nil, &OptionError{Param: param, Message: "must be a positive integer"}
+		}
+		*gap = value
+	}
+
+	return opts, nil
+}
+
+// GroupRegions merges regions into words, then lines and then blocks until it
+// reaches opts.Level. Every group keeps the regions it was built from as its
+// Children.
+func GroupRegions(regions []*Region, opts *GroupOptions) []*Region {
+	if opts == nil || opts.Level == "" {
+		return regions
+	}
+
+	// Words and lines only merge regions which share rows, blocks only merge
+	// lines which share columns.
+	groups := mergeRegions(regions, opts.WordGap, -1)
+	if opts.Level == GroupWords {
+		return groups
+	}
+
+	groups = mergeRegions(groups, opts.LineGap, -1)
+	if opts.Level == GroupLines {
+		return groups
+	}
+
+	return mergeRegions(groups, -1, opts.BlockGap)
+}
+
+// regionGaps returns how many empty columns and rows separate two regions,
+// negative when they overlap.
+func regionGaps(a, b *Region) (gapX, gapY int) {
+	gapX = b.X1 - a.X2 - 1
+	if gap := a.X1 - b.X2 - 1; gap > gapX {
+		gapX = gap
+	}
+
+	gapY = b.Y1 - a.Y2 - 1
+	if gap := a.Y1 - b.Y2 - 1; gap > gapY {
+		gapY = gap
+	}
+
+	return
+}
+
+// mergeRegions joins regions separated by at most maxGapX columns and maxGapY
+// rows, similar to run-length smoothing on the regions' bounding boxes. A max
+// gap of -1 requires the regions to overlap on that axis.
+func mergeRegions(regions []*Region, maxGapX, maxGapY int) []*Region {
+	groups := make([]*Region, len(regions))
+	for i, r := range regions {
+		groups[i] = &Region{
+			X1:       r.X1,
+			Y1:       r.Y1,
+			X2:       r.X2,
+			Y2:       r.Y2,
+			Pixels:   r.Pixels,
+			Children: []*Region{r},
+		}
+	}
+
+	// A merged group can grow close enough to others that weren't close to any
+	// of its members, keep merging until nothing changes.
+	merged := true
+	for merged {
+		merged = false
+
+		for i := 0; i < len(groups); i++ {
+			for j := i + 1; j < len(groups); j++ {
+				gapX, gapY := regionGaps(groups[i], groups[j])
+				if gapX > maxGapX || gapY > maxGapY {
+					continue
+				}
+
+				a, b := groups[i], groups[j]
+				if b.X1 < a.X1 {
+					a.X1 = b.X1
+				}
+				if b.Y1 < a.Y1 {
+					a.Y1 = b.Y1
+				}
+				if b.X2 > a.X2 {
+					a.X2 = b.X2
+				}
+				if b.Y2 > a.Y2 {
+					a.Y2 = b.Y2
+				}
+				a.Pixels += b.Pixels
+				a.Children = append(a.Children, b.Children...)
+
+				groups = append(groups[:j], groups[j+1:]...)
+				merged = true
+				j--
+			}
+		}
+	}
+
+	return groups
+}
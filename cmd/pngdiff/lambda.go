@@ -0,0 +1,29 @@
+package pngdiff
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// RequestIDHeader carries the ID a request is traced by across services.
+const RequestIDHeader = "X-Request-ID"
+
+// NewLambdaLogger returns a logger writing JSON records to stdout for
+// CloudWatch.
+func NewLambdaLogger() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(os.Stdout, nil))
+}
+
+// RequestID returns the caller's X-Request-ID from the headers of an API
+// Gateway request, which keep the case they were sent in, falling back to the
+// ID API Gateway assigned.
+func RequestID(headers map[string]string, fallback string) string {
+	for name, value := range headers {
+		if strings.EqualFold(name, RequestIDHeader) && value != "" {
+			return value
+		}
+	}
+
+	return fallback
+}
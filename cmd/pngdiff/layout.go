@@ -0,0 +1,186 @@
+package pngdiff
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"sort"
+)
+
+// Kinds of change reported by DiffLayout.
+const (
+	// LayoutAppeared means the region only exists in the compare image.
+	LayoutAppeared = "appeared"
+	// LayoutDisappeared means the region only exists in the base image.
+	LayoutDisappeared = "disappeared"
+	// LayoutMoved means the region kept its size but changed position.
+	LayoutMoved = "moved"
+	// LayoutResized means the region changed size.
+	LayoutResized = "resized"
+	// LayoutModified means the region kept its bounds but its content differs.
+	LayoutModified = "modified"
+	// LayoutUnchanged means the region kept its bounds and content.
+	LayoutUnchanged = "unchanged"
+)
+
+// MinimumLayoutIoU is how much two regions must overlap, as intersection over
+// union, to be matched when their content differs.
+const MinimumLayoutIoU = 0.5
+
+// LayoutChange pairs a region in the base image with its match in the
+// compare image.
+type LayoutChange struct {
+	Change  string  `json:"change"`
+	Base    *Region `json:"base,omitempty"`
+	Compare *Region `json:"compare,omitempty"`
+	IoU     float64 `json:"iou"`
+}
+
+// LayoutDiff summarizes how the regions of two images changed. Unchanged
+// regions are counted but not listed.
+type LayoutDiff struct {
+	Appeared    int             `json:"appeared"`
+	Disappeared int             `json:"disappeared"`
+	Moved       int             `json:"moved"`
+	Resized     int             `json:"resized"`
+	Modified    int             `json:"modified"`
+	Unchanged   int             `json:"unchanged"`
+	Changes     []*LayoutChange `json:"changes"`
+}
+
+// IoU calculates the intersection over union of two regions' bounding boxes.
+func IoU(a, b *Region) float64 {
+	intersection := a.Rectangle().Intersect(b.Rectangle())
+	if intersection.Empty() {
+		return 0
+	}
+
+	overlap := intersection.Dx() * intersection.Dy()
+	return float64(overlap) / float64(a.Area()+b.Area()-overlap)
+}
+
+// contentHash fingerprints the region's pixels relative to its bounding box,
+// so the same content hashes the same wherever it is in the image.
+func contentHash(img image.Image, r *Region) uint64 {
+	bounds := img.Bounds()
+	hash := fnv.New64a()
+
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header, uint32(r.Width()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(r.Height()))
+	hash.Write(header)
+
+	pixel := make([]byte, 4)
+	for y := r.Y1; y <= r.Y2; y++ {
+		for x := r.X1; x <= r.X2; x++ {
+			if !r.Contains(x, y) {
+				hash.Write([]byte{0, 0, 0, 0})
+				continue
+			}
+
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			pixel[0], pixel[1], pixel[2], pixel[3] = c.R, c.G, c.B, c.A
+			hash.Write(pixel)
+		}
+	}
+
+	return hash.Sum64()
+}
+
+// DiffLayout matches the regions detected in baseImage with those detected in
+// compareImage. Regions with identical content are matched first, wherever
+// they moved to, then the remaining regions are matched by how much they
+// overlap.
+func DiffLayout(baseImage, compareImage image.Image, baseRegions, compareRegions []*Region) *LayoutDiff {
+	diff := &LayoutDiff{Changes: []*LayoutChange{}}
+
+	baseHashes := make([]uint64, len(baseRegions))
+	for i, r := range baseRegions {
+		baseHashes[i] = contentHash(baseImage, r)
+	}
+
+	compareHashes := make([]uint64, len(compareRegions))
+	for i, r := range compareRegions {
+		compareHashes[i] = contentHash(compareImage, r)
+	}
+
+	type candidate struct {
+		base, compare int
+		sameContent   bool
+		iou           float64
+	}
+
+	candidates := []candidate{}
+	for i, base := range baseRegions {
+		for j, compare := range compareRegions {
+			c := candidate{
+				base:        i,
+				compare:     j,
+				sameContent: baseHashes[i] == compareHashes[j],
+				iou:         IoU(base, compare),
+			}
+
+			if c.sameContent || c.iou >= MinimumLayoutIoU {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+
+	// Prefer identical content, then the closest overlap
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].sameContent != candidates[j].sameContent {
+			return candidates[i].sameContent
+		}
+
+		return candidates[i].iou > candidates[j].iou
+	})
+
+	matchedBase := make([]bool, len(baseRegions))
+	matchedCompare := make([]bool, len(compareRegions))
+
+	for _, c := range candidates {
+		if matchedBase[c.base] || matchedCompare[c.compare] {
+			continue
+		}
+		matchedBase[c.base] = true
+		matchedCompare[c.compare] = true
+
+		base := baseRegions[c.base]
+		compare := compareRegions[c.compare]
+		change := &LayoutChange{Base: base, Compare: compare, IoU: c.iou}
+
+		switch {
+		case base.Width() != compare.Width() || base.Height() != compare.Height():
+			change.Change = LayoutResized
+			diff.Resized++
+		case base.Rectangle() != compare.Rectangle():
+			change.Change = LayoutMoved
+			diff.Moved++
+		case !c.sameContent:
+			change.Change = LayoutModified
+			diff.Modified++
+		default:
+			diff.Unchanged++
+			continue
+		}
+
+		diff.Changes = append(diff.Changes, change)
+	}
+
+	for i, base := range baseRegions {
+		if !matchedBase[i] {
+			diff.Disappeared++
+			diff.Changes = append(diff.Changes, &LayoutChange{Change: LayoutDisappeared, Base: base})
+		}
+	}
+
+	for j, compare := range compareRegions {
+		if !matchedCompare[j] {
+			diff.Appeared++
+			diff.Changes = append(diff.Changes, &LayoutChange{Change: LayoutAppeared, Compare: compare})
+		}
+	}
+
+	return diff
+}
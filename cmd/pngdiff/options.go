@@ -0,0 +1,301 @@
+package pngdiff
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Params describes every parameter ParseOptions understands.
+var Params = []struct {
+	Name  string
+	Usage string
+}{
+	{"image_url", "image to detect regions in"},
+	{"base_url", "image to compare against"},
+	{"compare_url", "image to compare with the base"},
+	{"connectivity", "4 or 8 connected pixels (default 8)"},
+	{"alpha_threshold", "alpha a pixel must exceed to be visible (default 127)"},
+	{"max_luminance", "ignore pixels brighter than this relative luminance (0-1)"},
+	{"background", "ignore pixels of this RRGGBB or RRGGBBAA color"},
+	{"ignore", "ignore x1,y1,x2,y2 rectangles separated by ;"},
+	{"dilation", "merge blobs within this many pixels"},
+	{"stats", "include statistics for every region"},
+	{"depth", "levels of nested regions to detect (default 1)"},
+	{"minimum_region_area", "fewest pixels in a region (default 25)"},
+	{"maximum_region_area", "most pixels in a region"},
+	{"min_width", "narrowest region"},
+	{"min_height", "shortest region"},
+	{"min_aspect", "smallest width to height ratio"},
+	{"max_aspect", "largest width to height ratio"},
+	{"sort", "reading, area or label (default reading)"},
+	{"limit", "most regions to return"},
+	{"group", "merge regions into words, lines or blocks"},
+	{"word_gap", "widest gap between glyphs in a word (default 3)"},
+	{"line_gap", "widest gap between words on a line (default 10)"},
+	{"block_gap", "tallest gap between lines in a block (default 6)"},
+	{"output", "json, annotated or labels (default json)"},
+}
+
+// OptionError explains why a parameter is invalid.
+type OptionError struct {
+	Param   string
+	Message string
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("invalid %s %s", e.Param, e.Message)
+}
+
+// Options holds every setting shared by the HTTP server, the Lambdas and the
+// CLI.
+type Options struct {
+	// Params holds the parameters the options were parsed from
+	Params map[string]string
+
+	ImageURL   string
+	BaseURL    string
+	CompareURL string
+
+	// Uploaded images are used instead of downloading their URL
+	Image        image.Image
+	BaseImage    image.Image
+	CompareImage image.Image
+
+	Region *RegionOptions
+	Group  *GroupOptions
+	Output string
+
+	// Logger receives download logs, defaults to slog.Default()
+	Logger *slog.Logger
+
+	// Timings collects how long downloading and decoding each image took
+	Timings *Timings
+
+	// Cache and OnDownload are passed to the Fetcher used by LoadImage
+	Cache      *ImageCache
+	OnDownload func(url string, size int, took time.Duration)
+
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+// ParseOptions builds Options from request parameters.
+func ParseOptions(params map[string]string) (opts *Options, err error) {
+	opts = &Options{
+		Params:     params,
+		ImageURL:   params["image_url"],
+		BaseURL:    params["base_url"],
+		CompareURL: params["compare_url"],
+	}
+
+	opts.Region, err = ParseRegionOptions(params)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Group, err = ParseGroupOptions(params)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Output, err = ParseOutput(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+// ParseQuery builds Options from the first value of each query parameter.
+func ParseQuery(values url.Values) (*Options, error) {
+	params := map[string]string{}
+	for key := range values {
+		params[key] = values.Get(key)
+	}
+
+	return ParseOptions(params)
+}
+
+// ValidURL reports whether the input is a URL or path DownloadImage can load.
+func ValidURL(input string) bool {
+	if input == "" {
+		return false
+	}
+
+	_, err := url.Parse(input)
+	return err == nil
+}
+
+// RequireImage validates the images needed to detect regions, compare_url is
+// optional and detects changes instead.
+func (o *Options) RequireImage() error {
+	if o.Image == nil && !ValidURL(o.ImageURL) {
+		return &OptionError{Param: "image_url", Message: "must be a valid URL"}
+	}
+
+	if o.CompareImage == nil && o.CompareURL != "" && !ValidURL(o.CompareURL) {
+		return &OptionError{Param: "compare_url", Message: "must be a valid URL"}
+	}
+
+	return nil
+}
+
+// RequirePair validates the images needed to compare two images.
+func (o *Options) RequirePair() error {
+	if o.BaseImage == nil && !ValidURL(o.BaseURL) {
+		return &OptionError{Param: "base_url", Message: "must be a valid URL"}
+	}
+
+	if o.CompareImage == nil && !ValidURL(o.CompareURL) {
+		return &OptionError{Param: "compare_url", Message: "must be a valid URL"}
+	}
+
+	return nil
+}
+
+// HasCompare reports whether a compare image was uploaded or given by URL.
+func (o *Options) HasCompare() bool {
+	return o.CompareImage != nil || o.CompareURL != ""
+}
+
+// LoadImage returns the uploaded image or downloads it from url, recording the
+// download_<name> and decode_<name> timings.
+func (o *Options) LoadImage(ctx context.Context, name string, uploaded image.Image, url string) (image.Image, error) {
+	if uploaded != nil {
+		return uploaded, nil
+	}
+
+	fetcher := &Fetcher{Logger: o.Logger, Cache: o.Cache, OnDownload: o.OnDownload}
+	img, hash, timing, err := fetcher.fetch(ctx, url)
+	if err == nil {
+		o.setContentHash(name, hash)
+	}
+	if timing.download > 0 {
+		o.Timings.Record("download_"+name, timing.download)
+	}
+	if timing.decode > 0 {
+		o.Timings.Record("decode_"+name, timing.decode)
+	}
+
+	return img, err
+}
+
+// SetContentHash records the SHA-256 of the PNG bytes of an uploaded image,
+// LoadImage records it for downloaded images.
+func (o *Options) SetContentHash(name string, body []byte) {
+	hash := sha256.Sum256(body)
+	o.setContentHash(name, hex.EncodeToString(hash[:]))
+}
+
+func (o *Options) setContentHash(name, hash string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.hashes == nil {
+		o.hashes = map[string]string{}
+	}
+	o.hashes[name] = hash
+}
+
+// ContentHash returns the hex SHA-256 of the PNG bytes of the named image,
+// empty until it's loaded.
+func (o *Options) ContentHash(name string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.hashes[name]
+}
+
+// LoadPair loads the base and compare images at the same time. The first
+// failure cancels the other download and is returned as an *ImageError.
+func (o *Options) LoadPair(ctx context.Context) (base, compare image.Image, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	load := func(name string, uploaded image.Image, url string, img *image.Image) {
+		defer wg.Done()
+
+		loaded, loadErr := o.LoadImage(ctx, name, uploaded, url)
+		if loadErr != nil {
+			once.Do(func() {
+				err = &ImageError{Param: name + "_url", Err: loadErr}
+				cancel()
+			})
+			return
+		}
+		*img = loaded
+	}
+
+	wg.Add(2)
+	go load("base", o.BaseImage, o.BaseURL, &base)
+	go load("compare", o.CompareImage, o.CompareURL, &compare)
+	wg.Wait()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return base, compare, nil
+}
+
+// LoadBoundsImages loads the image to detect regions in, and the compare
+// image when there is one. Failures are returned as an *ImageError.
+func (o *Options) LoadBoundsImages(ctx context.Context) (img, compare image.Image, err error) {
+	img, err = o.LoadImage(ctx, "image", o.Image, o.ImageURL)
+	if err != nil {
+		return nil, nil, &ImageError{Param: "image_url", Err: err}
+	}
+
+	if o.HasCompare() {
+		compare, err = o.LoadImage(ctx, "compare", o.CompareImage, o.CompareURL)
+		if err != nil {
+			return nil, nil, &ImageError{Param: "compare_url", Err: err}
+		}
+	}
+
+	return img, compare, nil
+}
+
+// DetectBounds detects and groups the regions in img, or the regions which
+// changed when compare isn't nil, returning the image to annotate them on.
+func (o *Options) DetectBounds(img, compare image.Image) (regions []*Region, annotate image.Image, err error) {
+	start := time.Now()
+	if compare != nil {
+		regions, err = DetectChanges(img, compare, o.Region)
+		o.Timings.Since("diff", start)
+	} else {
+		regions, err = DetectRegions(img, o.Region)
+		o.Timings.Since("detect", start)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Changes are drawn on the compare image
+	annotate = img
+	if compare != nil {
+		annotate = compare
+	}
+
+	return GroupRegions(regions, o.Group), annotate, nil
+}
+
+// Result is the outcome of diffing two images.
+type Result struct {
+	Additions int     `json:"additions"`
+	Deletions int     `json:"deletions"`
+	Diffs     int     `json:"diffs"`
+	Changes   float64 `json:"changes"`
+
+	// Cached is set when the result came from a ResultStore
+	Cached bool `json:"cached,omitempty"`
+}
@@ -1,83 +1,11 @@
 package pngdiff
 
 import (
-	"errors"
-	"fmt"
 	"image"
 	"image/color"
-	"image/png"
-	"io/ioutil"
 	"math"
-	"net/http"
-	"os"
 )
 
-func downloadFile(url string) (path string, err error) {
-	// Create the file
-	tmpfile, err := ioutil.TempFile("", "screenshot")
-	if err != nil {
-		return
-	}
-	path = tmpfile.Name()
-
-	// Get the data
-	resp, err := http.Get(url)
-	if err != nil {
-		return
-	}
-	defer resp.Body.Close()
-
-	// Writer the body to file
-	contents, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return
-	}
-
-	size, err := tmpfile.Write(contents)
-	if err != nil {
-		return
-	}
-	fmt.Printf("url=%s size=%d tmpfile=%s\n", url, size, path)
-
-	return
-}
-
-func loadImage(path string) (image.Image, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, errors.New("couldn't load the file")
-	}
-
-	loadedImage, err := png.Decode(file)
-	if err != nil {
-		return nil, errors.New("couldn't decode the PNG")
-	}
-
-	return loadedImage, nil
-}
-
-// DownloadImage loads an image from disk or downloads it from URL
-func DownloadImage(url string) (image.Image, error) {
-	// Load the image from disk if it's available
-	if img, err := loadImage(url); err == nil {
-		return img, nil
-	}
-
-	path, err := downloadFile(url)
-	if err != nil {
-		return nil, err
-	}
-
-	defer os.Remove(path)
-
-	image, err := loadImage(path)
-	if err != nil {
-		return nil, err
-	}
-
-	return image, nil
-}
-
 func samePixel(basePixel, comparePixel color.Color) bool {
 	baseR, baseG, baseB, baseA := basePixel.RGBA()
 	compareR, compareG, compareB, compareA := comparePixel.RGBA()
@@ -1,27 +1,51 @@
 package pngdiff
 
 import (
+	"fmt"
 	"image"
 	"image/color"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // Region is an area
+// X1, Y1 is the top left pixel and X2, Y2 the bottom right pixel of the
+// region, both inclusive, so a single pixel region has X1 == X2 and Y1 == Y2.
 type Region struct {
 	label int
 	X1    int `json:"x1"`
 	Y1    int `json:"y1"`
 	X2    int `json:"x2"`
 	Y2    int `json:"y2"`
+
+	// inRegion reports which pixels inside of the bounding box belong to the
+	// region, nil for groups which defer to their children.
+	inRegion func(x, y int) bool
+
+	// Pixels is the number of pixels that belong to the region, unlike Area
+	// which is the size of the bounding box.
+	Pixels int `json:"pixels"`
+
+	// Only set for regions returned by DetectChanges
+	Change     string  `json:"change,omitempty"`
+	Percentage float64 `json:"percentage,omitempty"`
+
+	// Only set when RegionOptions.Statistics is enabled
+	Stats *RegionStats `json:"stats,omitempty"`
+
+	// Only set when RegionOptions.Depth is greater than 1
+	Children []*Region `json:"children,omitempty"`
 }
 
 // Width calculates the region's width
 func (r *Region) Width() int {
-	return r.X2 - r.X1
+	return r.X2 - r.X1 + 1
 }
 
 // Height calculates the region's height
 func (r *Region) Height() int {
-	return r.Y2 - r.Y1
+	return r.Y2 - r.Y1 + 1
 }
 
 // Area calculates the region's total size
@@ -29,187 +53,611 @@ func (r *Region) Area() int {
 	return r.Width() * r.Height()
 }
 
-// Relative luminance
+// Contains reports whether the pixel at x, y belongs to the region, a grouped
+// region contains the pixels of its children.
+func (r *Region) Contains(x, y int) bool {
+	if !image.Pt(x, y).In(r.Rectangle()) {
+		return false
+	}
+
+	if r.inRegion != nil {
+		return r.inRegion(x, y)
+	}
+
+	for _, child := range r.Children {
+		if child.Contains(x, y) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Rectangle converts the region into an image.Rectangle, whose Max point is
+// exclusive.
+func (r *Region) Rectangle() image.Rectangle {
+	return image.Rect(r.X1, r.Y1, r.X2+1, r.Y2+1)
+}
+
+// Relative luminance scaled between 0 (black) and 1 (white)
 func relativeLuminance(pixel color.Color) float64 {
 	r, g, b, _ := pixel.RGBA()
-	return (0.2126 * float64(r)) + (0.7152 * float64(g)) + (0.0722 * float64(b))
+	return ((0.2126 * float64(r)) + (0.7152 * float64(g)) + (0.0722 * float64(b))) / 0xffff
 }
 
-// MinimumRegionArea defines how big a region must be.
+// MinimumRegionArea defines how many pixels a region must have.
 const MinimumRegionArea = 25
 
+// RegionOptions controls which pixels DetectRegions treats as part of a region
+// and how those pixels are connected.
+type RegionOptions struct {
+	// Connectivity is 4 to only join pixels sharing an edge or 8 to also join
+	// diagonal neighbors.
+	Connectivity int
+
+	// AlphaThreshold is the alpha a pixel must exceed to be visible.
+	AlphaThreshold uint8
+
+	// MaxLuminance ignores pixels brighter than the relative luminance (0-1)
+	// when set, useful for dark content on an opaque light background.
+	MaxLuminance float64
+
+	// Background ignores pixels of exactly this color when set.
+	Background color.Color
+
+	// Visible replaces the alpha, luminance and background checks when set.
+	Visible func(pixel color.Color) bool
+
+	// Ignore masks out every pixel inside of these rectangles.
+	Ignore []image.Rectangle
+
+	// Dilation merges blobs that are within this many pixels of each other.
+	Dilation int
+
+	// Statistics calculates RegionStats for every region.
+	Statistics bool
+
+	// Depth is how many levels of nested regions to detect. Each region's
+	// children are the blobs inside of it which differ from its dominant
+	// color, e.g. the buttons on a card and then the icons on a button.
+	Depth int
+
+	// MinArea and MaxArea bound the number of pixels in a region, a MaxArea of
+	// 0 means there is no upper bound.
+	MinArea int
+	MaxArea int
+
+	// MinWidth and MinHeight are the smallest bounding box kept.
+	MinWidth  int
+	MinHeight int
+
+	// MinAspect and MaxAspect bound the width divided by the height of a
+	// region, 0 disables either bound.
+	MinAspect float64
+	MaxAspect float64
+
+	// Sort orders the regions by SortReading, SortArea or SortLabel.
+	Sort string
+
+	// Limit is the most regions returned after sorting, 0 returns all of them.
+	Limit int
+}
+
+// Orders DetectRegions can return regions in.
+const (
+	// SortReading orders regions top to bottom and then left to right.
+	SortReading = "reading"
+	// SortArea orders regions from the most pixels to the least.
+	SortArea = "area"
+	// SortLabel orders regions by the order they were discovered in.
+	SortLabel = "label"
+)
+
+// DefaultRegionOptions returns the options DetectRegions uses when none are
+// given.
+func DefaultRegionOptions() *RegionOptions {
+	return &RegionOptions{
+		Connectivity: 8,
+		// Don't want faintly visible pixels to start the region
+		AlphaThreshold: 127,
+		Depth:          1,
+		MinArea:        MinimumRegionArea,
+		Sort:           SortReading,
+	}
+}
+
+func (o *RegionOptions) visible(pixel color.NRGBA) bool {
+	if o.Visible != nil {
+		return o.Visible(pixel)
+	}
+
+	if pixel.A <= o.AlphaThreshold {
+		return false
+	}
+
+	if o.Background != nil && samePixel(pixel, o.Background) {
+		return false
+	}
+
+	if o.MaxLuminance > 0 && relativeLuminance(pixel) > o.MaxLuminance {
+		return false
+	}
+
+	return true
+}
+
+// ignored reports whether the pixel is inside of an Ignore rectangle.
+func (o *RegionOptions) ignored(x, y int) bool {
+	point := image.Pt(x, y)
+	for _, rect := range o.Ignore {
+		if point.In(rect) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keep reports whether the region passes the size and shape filters.
+func (o *RegionOptions) keep(r *Region) bool {
+	if r.Pixels < o.MinArea || (o.MaxArea > 0 && r.Pixels > o.MaxArea) {
+		return false
+	}
+
+	if r.Width() < o.MinWidth || r.Height() < o.MinHeight {
+		return false
+	}
+
+	aspect := float64(r.Width()) / float64(r.Height())
+	if (o.MinAspect > 0 && aspect < o.MinAspect) || (o.MaxAspect > 0 && aspect > o.MaxAspect) {
+		return false
+	}
+
+	return true
+}
+
+// filter drops the regions which don't pass the filters, then sorts and
+// limits what is left.
+func (o *RegionOptions) filter(regions []*Region) []*Region {
+	filteredRegions := []*Region{}
+	for _, r := range regions {
+		if o.keep(r) {
+			filteredRegions = append(filteredRegions, r)
+		}
+	}
+
+	sort.Slice(filteredRegions, func(i, j int) bool {
+		a, b := filteredRegions[i], filteredRegions[j]
+
+		switch o.Sort {
+		case SortArea:
+			if a.Pixels != b.Pixels {
+				return a.Pixels > b.Pixels
+			}
+		case SortLabel:
+			return a.label < b.label
+		}
+
+		if a.Y1 != b.Y1 {
+			return a.Y1 < b.Y1
+		}
+		if a.X1 != b.X1 {
+			return a.X1 < b.X1
+		}
+
+		return a.label < b.label
+	})
+
+	if o.Limit > 0 && len(filteredRegions) > o.Limit {
+		filteredRegions = filteredRegions[:o.Limit]
+	}
+
+	return filteredRegions
+}
+
+// ParseRegionOptions builds RegionOptions from request parameters, falling back
+// to DefaultRegionOptions for anything missing.
+func ParseRegionOptions(params map[string]string) (*RegionOptions, error) {
+	opts := DefaultRegionOptions()
+
+	if v := params["connectivity"]; v != "" {
+		connectivity, err := strconv.Atoi(v)
+		if err != nil || (connectivity != 4 && connectivity != 8) {
+			return nil, &OptionError{Param: "connectivity", Message: "must be 4 or 8"}
+		}
+		opts.Connectivity = connectivity
+	}
+
+	if v := params["alpha_threshold"]; v != "" {
+		threshold, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return nil, &OptionError{Param: "alpha_threshold", Message: "must be between 0 and 255"}
+		}
+		opts.AlphaThreshold = uint8(threshold)
+	}
+
+	if v := params["max_luminance"]; v != "" {
+		luminance, err := strconv.ParseFloat(v, 64)
+		if err != nil || luminance < 0 || luminance > 1 {
+			return nil, &OptionError{Param: "max_luminance", Message: "must be between 0 and 1"}
+		}
+		opts.MaxLuminance = luminance
+	}
+
+	if v := params["background"]; v != "" {
+		background, err := parseHexColor(v)
+		if err != nil {
+			return nil, &OptionError{Param: "background", Message: "must be RRGGBB or RRGGBBAA"}
+		}
+		opts.Background = background
+	}
+
+	if v := params["ignore"]; v != "" {
+		ignore, err := parseRectangles(v)
+		if err != nil {
+			return nil, &OptionError{Param: "ignore", Message: "must be x1,y1,x2,y2 rectangles separated by ;"}
+		}
+		opts.Ignore = ignore
+	}
+
+	if v := params["dilation"]; v != "" {
+		dilation, err := strconv.Atoi(v)
+		if err != nil || dilation < 0 {
+			return nil, &OptionError{Param: "dilation", Message: "must be a positive integer"}
+		}
+		opts.Dilation = dilation
+	}
+
+	if v := params["depth"]; v != "" {
+		depth, err := strconv.Atoi(v)
+		if err != nil || depth < 1 {
+			return nil, &OptionError{Param: "depth", Message: "must be 1 or more"}
+		}
+		opts.Depth = depth
+	}
+
+	ints := map[string]*int{
+		"minimum_region_area": &opts.MinArea,
+		"maximum_region_area": &opts.MaxArea,
+		"min_width":           &opts.MinWidth,
+		"min_height":          &opts.MinHeight,
+		"limit":               &opts.Limit,
+	}
+	for param, value := range ints {
+		v := params[param]
+		if v == "" {
+			continue
+		}
+
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			return nil, &OptionError{Param: param, Message: "must be a positive integer"}
+		}
+		*value = i
+	}
+
+	floats := map[string]*float64{
+		"min_aspect": &opts.MinAspect,
+		"max_aspect": &opts.MaxAspect,
+	}
+	for param, value := range floats {
+		v := params[param]
+		if v == "" {
+			continue
+		}
+
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return nil, &OptionError{Param: param, Message: "must be a positive number"}
+		}
+		*value = f
+	}
+
+	switch order := params["sort"]; order {
+	case "":
+	case SortReading, SortArea, SortLabel:
+		opts.Sort = order
+	default:
+		return nil, &OptionError{Param: "sort", Message: "must be reading, area or label"}
+	}
+
+	if v := params["stats"]; v != "" {
+		statistics, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, &OptionError{Param: "stats", Message: "must be true or false"}
+		}
+		opts.Statistics = statistics
+	}
+
+	return opts, nil
+}
+
+// parseHexColor parses RRGGBB or RRGGBBAA with an optional leading #.
+func parseHexColor(input string) (color.Color, error) {
+	hex := strings.TrimPrefix(input, "#")
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 8 {
+		return nil, fmt.Errorf("invalid color %q must be RRGGBB or RRGGBBAA", input)
+	}
+
+	return color.NRGBA{
+		R: uint8(value >> 24),
+		G: uint8(value >> 16),
+		B: uint8(value >> 8),
+		A: uint8(value),
+	}, nil
+}
+
+// parseRectangles parses x1,y1,x2,y2 rectangles separated by ; where both
+// corners are inclusive like a Region's.
+func parseRectangles(input string) ([]image.Rectangle, error) {
+	rects := []image.Rectangle{}
+	for _, rect := range strings.Split(input, ";") {
+		corners := strings.Split(rect, ",")
+		if len(corners) != 4 {
+			return nil, fmt.Errorf("invalid rectangle %q", rect)
+		}
+
+		var points [4]int
+		for i, corner := range corners {
+			point, err := strconv.Atoi(strings.TrimSpace(corner))
+			if err != nil {
+				return nil, err
+			}
+			points[i] = point
+		}
+
+		rects = append(rects, image.Rect(points[0], points[1], points[2]+1, points[3]+1))
+	}
+
+	return rects, nil
+}
+
 // DetectRegions finds regions
 // Uses Connected-component labeling https://en.wikipedia.org/wiki/Connected-component_labeling
-func DetectRegions(img image.Image) (regions []*Region, err error) {
-	imageWidth := img.Bounds().Dx()
-	imageHeight := img.Bounds().Dy()
+func DetectRegions(img image.Image, opts *RegionOptions) (regions []*Region, err error) {
+	if opts == nil {
+		opts = DefaultRegionOptions()
+	}
 
-	imageData := img.(*image.NRGBA)
-	var nn, nw, ne, ww, ee, sw, ss, se, minIndex int
-	var pos int
+	bounds := img.Bounds()
+	imageWidth := bounds.Dx()
+	imageHeight := bounds.Dy()
+
+	visible := make([][]bool, imageHeight)
+	for y := 0; y < imageHeight; y++ {
+		visible[y] = make([]bool, imageWidth)
 
-	// Keeps track of label keys
-	blobMap := make([][]int, imageHeight)
-	labelCounter := 1
-	labels := []int{0}
+		for x := 0; x < imageWidth; x++ {
+			var pixel color.NRGBA
+			if imageData, ok := img.(*image.NRGBA); ok {
+				pixel = imageData.NRGBAAt(bounds.Min.X+x, bounds.Min.Y+y)
+			} else {
+				pixel = color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			}
 
-	// Variables for neigboring pixels
+			visible[y][x] = !opts.ignored(x, y) && opts.visible(pixel)
+		}
+	}
 
-	isVisible := false
+	blobMap, blobs := labelRegions(visible, opts)
 
-	// Label every pixel as 0
-	for y := 0; y < imageHeight; y++ {
-		blobMap[y] = make([]int, imageWidth)
+	for _, r := range blobs {
+		label := r.label
+		r.inRegion = func(x, y int) bool {
+			return y >= 0 && y < imageHeight && x >= 0 && x < imageWidth && blobMap[y][x] == label
+		}
+
+		regions = append(regions, r)
 	}
+	regions = opts.filter(regions)
 
-	// Need to make two passes
-	// First to identify all of the blob candidates
-	// Second pass merges any blobs that the first pass failed to merge
-	nIter := 2
-	for nIter > 0 {
-		// Leave a 1 pixel border which is ignored so we do not get array out of
-		// bound errors
-		for y := 1; y < imageHeight-1; y++ {
-			for x := 1; x < imageWidth-1; x++ {
-				pos = (y*imageWidth + x) * 4
-
-				// Don't want faintly visible pixels to start the region
-				if imageData.Pix[pos+3] > 127 {
-					isVisible = true
-				} else {
-					isVisible = false
-				}
+	for _, r := range regions {
+		if opts.Statistics {
+			r.Stats = regionStats(img, r, r.inRegion)
+		}
 
-				if isVisible {
-					nw = blobMap[y-1][x-1] // top left
-					nn = blobMap[y-1][x-0] // above
-					ne = blobMap[y-1][x+1] // top right
-					ww = blobMap[y-0][x-1] // left
-					ee = blobMap[y-0][x+1] // right
-					sw = blobMap[y+1][x-1] // bottom left
-					ss = blobMap[y+1][x-0] // beneath
-					se = blobMap[y+1][x+1] // bottom right
-					minIndex = ww
-
-					if 0 < ww && ww < minIndex {
-						minIndex = ww
-					}
-
-					if 0 < ee && ee < minIndex {
-						minIndex = ee
-					}
-
-					if 0 < nn && nn < minIndex {
-						minIndex = nn
-					}
-
-					if 0 < ne && ne < minIndex {
-						minIndex = ne
-					}
-
-					if 0 < nw && nw < minIndex {
-						minIndex = nw
-					}
-
-					if 0 < ss && ss < minIndex {
-						minIndex = ss
-					}
-
-					if 0 < se && se < minIndex {
-						minIndex = se
-					}
-
-					if 0 < sw && sw < minIndex {
-						minIndex = sw
-					}
-
-					if minIndex == 0 {
-						blobMap[y][x] = labelCounter
-						labels = append(labels, labelCounter)
-						labelCounter++
-					} else {
-						if minIndex < labels[nw] {
-							labels[nw] = minIndex
-						}
-
-						if minIndex < labels[nn] {
-							labels[nn] = minIndex
-						}
-
-						if minIndex < labels[ne] {
-							labels[ne] = minIndex
-						}
-
-						if minIndex < labels[ww] {
-							labels[ww] = minIndex
-						}
-
-						if minIndex < labels[ee] {
-							labels[ee] = minIndex
-						}
-
-						if minIndex < labels[sw] {
-							labels[sw] = minIndex
-						}
-
-						if minIndex < labels[ss] {
-							labels[ss] = minIndex
-						}
-
-						if minIndex < labels[se] {
-							labels[se] = minIndex
-						}
-
-						blobMap[y][x] = minIndex
-					}
-				} else {
-					blobMap[y][x] = 0
-				}
+		r.Children = detectChildren(img, r, opts, opts.Depth-1)
+	}
+
+	return
+}
+
+// detectChildren finds the regions nested inside of r by labeling its pixels
+// which differ from its dominant color, descending depth more levels.
+func detectChildren(img image.Image, r *Region, opts *RegionOptions, depth int) (children []*Region) {
+	if depth <= 0 {
+		return
+	}
+
+	bounds := img.Bounds()
+	colorAt := func(x, y int) color.NRGBA {
+		return color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+	}
+
+	colors := map[color.NRGBA]int{}
+	for y := r.Y1; y <= r.Y2; y++ {
+		for x := r.X1; x <= r.X2; x++ {
+			if r.inRegion(x, y) {
+				colors[colorAt(x, y)]++
 			}
 		}
+	}
+	background := dominantColor(colors)
+
+	// Label within the region's bounding box, offsetting back to image
+	// coordinates afterwards
+	width := r.Width()
+	height := r.Height()
+	visible := make([][]bool, height)
+	for y := 0; y < height; y++ {
+		visible[y] = make([]bool, width)
+
+		for x := 0; x < width; x++ {
+			visible[y][x] = r.inRegion(r.X1+x, r.Y1+y) && colorAt(r.X1+x, r.Y1+y) != background
+		}
+	}
+
+	blobMap, blobs := labelRegions(visible, opts)
+
+	for _, child := range blobs {
+		label := child.label
+		child.inRegion = func(x, y int) bool {
+			x -= r.X1
+			y -= r.Y1
+			return y >= 0 && y < height && x >= 0 && x < width && blobMap[y][x] == label
+		}
 
-		nIter--
+		child.X1 += r.X1
+		child.X2 += r.X1
+		child.Y1 += r.Y1
+		child.Y2 += r.Y1
+		children = append(children, child)
 	}
+	children = opts.filter(children)
 
-	// Compress the table of labels so that every location refers to only 1
-	// matching location
-	for i, label := range labels {
-		for label != labels[label] {
-			label = labels[label]
+	for _, child := range children {
+		if opts.Statistics {
+			child.Stats = regionStats(img, child, child.inRegion)
 		}
 
-		labels[i] = label
+		child.Children = detectChildren(img, child, opts, depth-1)
 	}
 
-	// Merge the blobs with multiple labels
+	return
+}
+
+// dilate grows every visible pixel into a square with the given radius so
+// blobs separated by small gaps end up touching.
+func dilate(visible [][]bool, radius int) [][]bool {
+	height := len(visible)
+	if height == 0 || radius <= 0 {
+		return visible
+	}
+	width := len(visible[0])
+
+	// Horizontal pass followed by a vertical pass over its result
+	horizontal := make([][]bool, height)
+	for y := 0; y < height; y++ {
+		horizontal[y] = make([]bool, width)
+		lastVisible := -radius - 1
+
+		for x := 0; x < width+radius; x++ {
+			if x < width && visible[y][x] {
+				lastVisible = x
+			}
+
+			if x-radius >= 0 && x-lastVisible <= 2*radius {
+				horizontal[y][x-radius] = true
+			}
+		}
+	}
+
+	dilated := make([][]bool, height)
+	for y := 0; y < height; y++ {
+		dilated[y] = make([]bool, width)
+	}
+
+	for x := 0; x < width; x++ {
+		lastVisible := -radius - 1
+
+		for y := 0; y < height+radius; y++ {
+			if y < height && horizontal[y][x] {
+				lastVisible = y
+			}
+
+			if y-radius >= 0 && y-lastVisible <= 2*radius {
+				dilated[y-radius][x] = true
+			}
+		}
+	}
+
+	return dilated
+}
+
+// labelRegions runs a two pass connected-component labeling over the visible
+// pixels, tracking equivalent labels with union-find. It returns the label of
+// every pixel along with the region for each label.
+func labelRegions(visible [][]bool, opts *RegionOptions) (blobMap [][]int, blobs map[int]*Region) {
+	imageHeight := len(visible)
+	imageWidth := 0
+	if imageHeight > 0 {
+		imageWidth = len(visible[0])
+	}
+
+	// Label the dilated pixels so nearby blobs are joined, the regions are
+	// still built from the visible pixels only.
+	connected := dilate(visible, opts.Dilation)
+
+	// Label every pixel as 0
+	blobMap = make([][]int, imageHeight)
+	for y := 0; y < imageHeight; y++ {
+		blobMap[y] = make([]int, imageWidth)
+	}
+
+	// Neighbors which have already been visited in a row-major scan: left and
+	// above, plus top left and top right with 8-connectivity.
+	neighbors := []image.Point{{-1, 0}, {0, -1}}
+	if opts.Connectivity != 4 {
+		neighbors = append(neighbors, image.Point{-1, -1}, image.Point{1, -1})
+	}
+
+	// parents links every provisional label to an equivalent smaller label,
+	// label 0 is the background.
+	parents := []int{0}
+
+	// First pass assigns provisional labels and records which of them touch
 	for y := 0; y < imageHeight; y++ {
 		for x := 0; x < imageWidth; x++ {
-			label := blobMap[y][x]
-			if label == 0 {
+			if !connected[y][x] {
 				continue
 			}
 
-			for label != labels[label] {
-				label = labels[label]
+			label := 0
+			for _, n := range neighbors {
+				nx, ny := x+n.X, y+n.Y
+				if nx < 0 || ny < 0 || nx >= imageWidth {
+					continue
+				}
+
+				neighbor := blobMap[ny][nx]
+				if neighbor == 0 {
+					continue
+				}
+
+				if label == 0 {
+					label = neighbor
+				} else {
+					unionLabels(parents, label, neighbor)
+				}
+			}
+
+			if label == 0 {
+				label = len(parents)
+				parents = append(parents, label)
 			}
+
 			blobMap[y][x] = label
 		}
 	}
 
-	// Since the same label key:value pair are appended to the labelTable map,
-	// we can just lookup. Not sure if necessary in practice?
+	// Second pass replaces every provisional label with its root. Pixels only
+	// labeled because of dilation don't belong to any region.
 	for y := 0; y < imageHeight; y++ {
 		for x := 0; x < imageWidth; x++ {
-			label := blobMap[y][x]
-			if label == 0 || label == labels[label] {
-				continue
+			if !visible[y][x] {
+				blobMap[y][x] = 0
+			} else if label := blobMap[y][x]; label > 0 {
+				blobMap[y][x] = findLabel(parents, label)
 			}
-
-			blobMap[y][x] = labels[label]
 		}
 	}
 
-	blobs := map[int]*Region{}
+	blobs = map[int]*Region{}
 	for y := 0; y < imageHeight; y++ {
 		for x := 0; x < imageWidth; x++ {
 			label := blobMap[y][x]
@@ -232,23 +680,51 @@ func DetectRegions(img image.Image) (regions []*Region, err error) {
 				if b.Y2 < y {
 					b.Y2 = y
 				}
+
+				b.Pixels++
 			} else {
 				// Encountered a label for the first time, establish the region with
 				// kwnon coordinates.
 				blobs[label] = &Region{
-					label: label,
-					X1:    x,
-					Y1:    y,
-					X2:    x,
-					Y2:    y,
+					label:  label,
+					X1:     x,
+					Y1:     y,
+					X2:     x,
+					Y2:     y,
+					Pixels: 1,
 				}
 			}
 		}
 	}
 
-	for _, r := range blobs {
-		regions = append(regions, r)
+	return
+}
+
+// findLabel returns the root of the label, compressing the path along the way
+// so later lookups are constant time.
+func findLabel(parents []int, label int) int {
+	root := label
+	for root != parents[root] {
+		root = parents[root]
 	}
 
-	return
+	for label != root {
+		next := parents[label]
+		parents[label] = root
+		label = next
+	}
+
+	return root
+}
+
+// unionLabels marks both labels as the same region, keeping the smaller root.
+func unionLabels(parents []int, a, b int) {
+	a = findLabel(parents, a)
+	b = findLabel(parents, b)
+
+	if a < b {
+		parents[b] = a
+	} else if b < a {
+		parents[a] = b
+	}
 }
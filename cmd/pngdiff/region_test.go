@@ -0,0 +1,320 @@
+package pngdiff
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// parseGrid reads rows of # for visible pixels and . for everything else.
+func parseGrid(rows ...string) [][]bool {
+	visible := make([][]bool, len(rows))
+	for y, row := range rows {
+		visible[y] = make([]bool, len(row))
+		for x, c := range row {
+			visible[y][x] = c == '#'
+		}
+	}
+
+	return visible
+}
+
+// floodFill labels the visible pixels with a breadth first search, the
+// obviously correct but slower reference labelRegions is checked against.
+func floodFill(visible [][]bool, connectivity int) (labels [][]int, count int) {
+	neighbors := []image.Point{{-1, 0}, {1, 0}, {0, -1}, {0, 1}}
+	if connectivity == 8 {
+		neighbors = append(neighbors, image.Point{-1, -1}, image.Point{1, -1}, image.Point{-1, 1}, image.Point{1, 1})
+	}
+
+	labels = make([][]int, len(visible))
+	for y := range visible {
+		labels[y] = make([]int, len(visible[y]))
+	}
+
+	for y := range visible {
+		for x := range visible[y] {
+			if !visible[y][x] || labels[y][x] != 0 {
+				continue
+			}
+
+			count++
+			labels[y][x] = count
+			queue := []image.Point{{x, y}}
+			for len(queue) > 0 {
+				p := queue[0]
+				queue = queue[1:]
+
+				for _, n := range neighbors {
+					q := p.Add(n)
+					if q.Y < 0 || q.Y >= len(visible) || q.X < 0 || q.X >= len(visible[q.Y]) {
+						continue
+					}
+					if visible[q.Y][q.X] && labels[q.Y][q.X] == 0 {
+						labels[q.Y][q.X] = count
+						queue = append(queue, q)
+					}
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// checkPartition fails unless blobMap groups the pixels exactly like want.
+func checkPartition(t *testing.T, blobMap, want [][]int) {
+	t.Helper()
+
+	// Labels differ between the two, but must map one to one
+	forward := map[int]int{}
+	backward := map[int]int{}
+	for y := range want {
+		for x := range want[y] {
+			got, expected := blobMap[y][x], want[y][x]
+			if (got == 0) != (expected == 0) {
+				t.Fatalf("pixel %d,%d labeled %d, want it labeled like %d", x, y, got, expected)
+			}
+			if got == 0 {
+				continue
+			}
+
+			if f, ok := forward[got]; ok && f != expected {
+				t.Fatalf("label %d at %d,%d spans two components", got, x, y)
+			}
+			if b, ok := backward[expected]; ok && b != got {
+				t.Fatalf("component at %d,%d is split between labels %d and %d", x, y, b, got)
+			}
+			forward[got] = expected
+			backward[expected] = got
+		}
+	}
+}
+
+var spiral = []string{
+	"###########",
+	"..........#",
+	"#########.#",
+	"#.......#.#",
+	"#.#####.#.#",
+	"#.#...#.#.#",
+	"#.#.###.#.#",
+	"#.#.....#.#",
+	"#.#######.#",
+	"#.........#",
+	"###########",
+}
+
+func TestLabelRegions(t *testing.T) {
+	tests := []struct {
+		name         string
+		grid         []string
+		connectivity int
+		regions      int
+	}{
+		{"spiral", spiral, 4, 1},
+		{"spiral 8-connected", spiral, 8, 1},
+		{"comb joined at the bottom", []string{
+			"#.#.#.#.#.#",
+			"#.#.#.#.#.#",
+			"#.#.#.#.#.#",
+			"###########",
+		}, 4, 1},
+		{"comb joined at the top", []string{
+			"###########",
+			"#.#.#.#.#.#",
+			"#.#.#.#.#.#",
+		}, 4, 1},
+		{"comb joined at the far right", []string{
+			"###########",
+			"..........#",
+			"###########",
+			"..........#",
+			"###########",
+			"..........#",
+			"..........#",
+		}, 4, 1},
+		{"teeth without a spine", []string{
+			"#.#.#.#",
+			"#.#.#.#",
+		}, 8, 4},
+		{"single pixels", []string{
+			"#.#.#",
+			".....",
+			"#.#.#",
+		}, 8, 6},
+		{"only pixel", []string{"#"}, 4, 1},
+		{"nothing visible", []string{"...", "..."}, 8, 0},
+		{"diagonal 4-connected", []string{
+			"#....",
+			".#...",
+			"..#..",
+			"...#.",
+			"....#",
+		}, 4, 5},
+		{"diagonal 8-connected", []string{
+			"#....",
+			".#...",
+			"..#..",
+			"...#.",
+			"....#",
+		}, 8, 1},
+		{"anti-diagonal 8-connected", []string{
+			"....#",
+			"...#.",
+			"..#..",
+			".#...",
+			"#....",
+		}, 8, 1},
+		{"checkerboard 4-connected", []string{
+			"#.#.",
+			".#.#",
+			"#.#.",
+		}, 4, 6},
+		{"checkerboard 8-connected", []string{
+			"#.#.",
+			".#.#",
+			"#.#.",
+		}, 8, 1},
+		{"border", []string{
+			"######",
+			"#....#",
+			"#.##.#",
+			"#....#",
+			"######",
+		}, 4, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			visible := parseGrid(test.grid...)
+			opts := &RegionOptions{Connectivity: test.connectivity}
+
+			blobMap, blobs := labelRegions(visible, opts)
+			if len(blobs) != test.regions {
+				t.Fatalf("found %d regions, want %d", len(blobs), test.regions)
+			}
+
+			want, count := floodFill(visible, test.connectivity)
+			if count != test.regions {
+				t.Fatalf("flood fill found %d regions, want %d", count, test.regions)
+			}
+			checkPartition(t, blobMap, want)
+
+			pixels := 0
+			for _, r := range blobs {
+				pixels += r.Pixels
+			}
+			if visiblePixels := strings.Count(strings.Join(test.grid, ""), "#"); pixels != visiblePixels {
+				t.Errorf("regions have %d pixels, want %d", pixels, visiblePixels)
+			}
+		})
+	}
+}
+
+func TestLabelRegionsBounds(t *testing.T) {
+	_, blobs := labelRegions(parseGrid(spiral...), &RegionOptions{Connectivity: 4})
+	for _, r := range blobs {
+		if r.X1 != 0 || r.Y1 != 0 || r.X2 != 10 || r.Y2 != 10 {
+			t.Errorf("spiral bounds are %d,%d %d,%d, want 0,0 10,10", r.X1, r.Y1, r.X2, r.Y2)
+		}
+	}
+
+	_, blobs = labelRegions(parseGrid("...", ".#.", "..."), &RegionOptions{Connectivity: 8})
+	for _, r := range blobs {
+		if r.X1 != 1 || r.Y1 != 1 || r.X2 != 1 || r.Y2 != 1 || r.Area() != 1 {
+			t.Errorf("single pixel bounds are %d,%d %d,%d, want 1,1 1,1", r.X1, r.Y1, r.X2, r.Y2)
+		}
+	}
+}
+
+func TestLabelRegionsDilation(t *testing.T) {
+	grid := parseGrid(
+		"##...##",
+		"##...##",
+		".......",
+		".......",
+		".......",
+		"##.....",
+	)
+
+	tests := []struct {
+		dilation int
+		regions  int
+	}{
+		{0, 3},
+		// Gaps of 3 pixels close once both sides grow by 2
+		{1, 3},
+		{2, 1},
+	}
+
+	for _, test := range tests {
+		blobMap, blobs := labelRegions(grid, &RegionOptions{Connectivity: 8, Dilation: test.dilation})
+		if len(blobs) != test.regions {
+			t.Errorf("dilation %d found %d regions, want %d", test.dilation, len(blobs), test.regions)
+		}
+
+		// Pixels only reached by dilating don't belong to a region
+		pixels := 0
+		for _, r := range blobs {
+			pixels += r.Pixels
+		}
+		if pixels != 10 {
+			t.Errorf("dilation %d regions have %d pixels, want 10", test.dilation, pixels)
+		}
+		if blobMap[0][3] != 0 {
+			t.Errorf("dilation %d labeled the gap between blobs", test.dilation)
+		}
+	}
+}
+
+func TestFindLabelCompressesPaths(t *testing.T) {
+	parents := []int{0, 1, 1, 2, 3, 4}
+
+	if root := findLabel(parents, 5); root != 1 {
+		t.Fatalf("root is %d, want 1", root)
+	}
+	for label := 1; label < len(parents); label++ {
+		if parents[label] != 1 {
+			t.Errorf("label %d points at %d after compressing, want 1", label, parents[label])
+		}
+	}
+
+	unionLabels(parents, 5, 0)
+	if root := findLabel(parents, 3); root != 0 {
+		t.Errorf("union kept root %d, want the smaller root 0", root)
+	}
+}
+
+func TestDetectRegionsSinglePixels(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 5, 5))
+	black := color.NRGBA{0, 0, 0, 255}
+	img.SetNRGBA(0, 0, black)
+	img.SetNRGBA(4, 4, black)
+	img.SetNRGBA(2, 2, black)
+
+	opts := DefaultRegionOptions()
+	opts.MinArea = 0
+	opts.Connectivity = 4
+
+	regions, err := DetectRegions(img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(regions) != 3 {
+		t.Fatalf("found %d regions, want 3", len(regions))
+	}
+
+	// Sorted in reading order
+	for i, want := range []image.Point{{0, 0}, {2, 2}, {4, 4}} {
+		if r := regions[i]; r.X1 != want.X || r.Y1 != want.Y || r.Pixels != 1 {
+			t.Errorf("region %d is at %d,%d with %d pixels, want %v with 1", i, r.X1, r.Y1, r.Pixels, want)
+		}
+	}
+
+	// The default minimum area drops them
+	if regions, _ := DetectRegions(img, nil); len(regions) != 0 {
+		t.Errorf("found %d regions with the default options, want 0", len(regions))
+	}
+}
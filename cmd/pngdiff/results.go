@@ -0,0 +1,148 @@
+package pngdiff
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ResultStore remembers the Result of diffing a pair of images so the same
+// pair isn't diffed twice.
+type ResultStore interface {
+	// Get returns the stored result for key, ok is false when there isn't one.
+	Get(ctx context.Context, key string) (result *Result, ok bool, err error)
+	Put(ctx context.Context, key string, result *Result) error
+}
+
+// ResultKey identifies a result by the content hashes of its images. Diff
+// takes no options so none of the request's parameters change its Result.
+func ResultKey(hashes ...string) string {
+	hash := sha256.New()
+	for _, h := range hashes {
+		hash.Write([]byte(h + "\n"))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// MemoryResultStore keeps the most recently used results in memory.
+type MemoryResultStore struct {
+	maxResults int
+
+	mu      sync.Mutex
+	lru     list.List
+	results map[string]*list.Element
+}
+
+type storedResult struct {
+	key    string
+	result Result
+}
+
+// NewMemoryResultStore creates a store holding up to maxResults results.
+func NewMemoryResultStore(maxResults int) *MemoryResultStore {
+	return &MemoryResultStore{
+		maxResults: maxResults,
+		results:    map[string]*list.Element{},
+	}
+}
+
+// Get returns a copy of the result stored for key.
+func (s *MemoryResultStore) Get(ctx context.Context, key string) (*Result, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.results[key]
+	if !ok {
+		return nil, false, nil
+	}
+	s.lru.MoveToFront(elem)
+
+	result := elem.Value.(*storedResult).result
+	return &result, true, nil
+}
+
+// Put stores a copy of result, evicting the least recently used result when
+// the store is full.
+func (s *MemoryResultStore) Put(ctx context.Context, key string, result *Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.results[key]; ok {
+		elem.Value.(*storedResult).result = *result
+		s.lru.MoveToFront(elem)
+		return nil
+	}
+
+	s.results[key] = s.lru.PushFront(&storedResult{key: key, result: *result})
+	for s.lru.Len() > s.maxResults {
+		oldest := s.lru.Remove(s.lru.Back()).(*storedResult)
+		delete(s.results, oldest.key)
+	}
+
+	return nil
+}
+
+// FileResultStore keeps results as JSON files in Dir so they survive
+// restarts and can be shared by processes on the same disk.
+type FileResultStore struct {
+	Dir string
+}
+
+func (s *FileResultStore) path(key string) string {
+	return filepath.Join(s.Dir, key+".json")
+}
+
+// Get reads the result stored for key.
+func (s *FileResultStore) Get(ctx context.Context, key string) (*Result, bool, error) {
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	result := &Result{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, false, err
+	}
+
+	return result, true, nil
+}
+
+// Put writes the result for key, replacing the file atomically so readers
+// never see a partial result.
+func (s *FileResultStore) Put(ctx context.Context, key string, result *Result) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	tmpfile, err := os.CreateTemp(s.Dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write(data); err != nil {
+		tmpfile.Close()
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpfile.Name(), s.path(key))
+}
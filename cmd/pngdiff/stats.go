@@ -0,0 +1,107 @@
+package pngdiff
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Point is a location which can fall between pixels.
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// RegionStats describes the pixels inside of a Region.
+type RegionStats struct {
+	// Centroid is the average position of the region's pixels.
+	Centroid Point `json:"centroid"`
+
+	// Perimeter is the number of region pixels touching a pixel outside of the
+	// region, including the edge of the image.
+	Perimeter int `json:"perimeter"`
+
+	// FillRatio is how much of the bounding box the region's pixels cover,
+	// between 0 and 1.
+	FillRatio float64 `json:"fill_ratio"`
+
+	// DominantColor is the most common color in the region as #rrggbbaa.
+	DominantColor string `json:"dominant_color"`
+
+	// AverageLuminance is the mean relative luminance of the region's pixels,
+	// between 0 and 1.
+	AverageLuminance float64 `json:"average_luminance"`
+
+	// Mask is the run-length encoding of the region's pixels within its
+	// bounding box, read row by row. Runs alternate between pixels outside and
+	// inside of the region, starting with outside, so it may begin with 0.
+	Mask []int `json:"mask"`
+}
+
+// regionStats measures the region in img, inRegion reports which pixels
+// belong to it.
+func regionStats(img image.Image, r *Region, inRegion func(x, y int) bool) *RegionStats {
+	bounds := img.Bounds()
+	stats := &RegionStats{}
+
+	var sumX, sumY, sumLuminance float64
+	colors := map[color.NRGBA]int{}
+
+	inside := false
+	run := 0
+
+	for y := r.Y1; y <= r.Y2; y++ {
+		for x := r.X1; x <= r.X2; x++ {
+			if inRegion(x, y) != inside {
+				stats.Mask = append(stats.Mask, run)
+				inside = !inside
+				run = 0
+			}
+			run++
+
+			if !inside {
+				continue
+			}
+
+			pixel := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			colors[pixel]++
+			sumLuminance += relativeLuminance(pixel)
+			sumX += float64(x)
+			sumY += float64(y)
+
+			if !inRegion(x-1, y) || !inRegion(x+1, y) || !inRegion(x, y-1) || !inRegion(x, y+1) {
+				stats.Perimeter++
+			}
+		}
+	}
+	stats.Mask = append(stats.Mask, run)
+
+	pixels := float64(r.Pixels)
+	stats.Centroid = Point{X: sumX / pixels, Y: sumY / pixels}
+	stats.FillRatio = pixels / float64(r.Area())
+	stats.AverageLuminance = sumLuminance / pixels
+
+	dominant := dominantColor(colors)
+	stats.DominantColor = fmt.Sprintf("#%02x%02x%02x%02x", dominant.R, dominant.G, dominant.B, dominant.A)
+
+	return stats
+}
+
+// dominantColor picks the most frequent color.
+func dominantColor(colors map[color.NRGBA]int) (dominant color.NRGBA) {
+	dominantCount := 0
+	for c, count := range colors {
+		// Break ties on the color itself so the result doesn't depend on map
+		// ordering
+		if count > dominantCount || (count == dominantCount && packColor(c) < packColor(dominant)) {
+			dominant = c
+			dominantCount = count
+		}
+	}
+
+	return
+}
+
+func packColor(c color.NRGBA) uint32 {
+	return uint32(c.R)<<24 | uint32(c.G)<<16 | uint32(c.B)<<8 | uint32(c.A)
+}
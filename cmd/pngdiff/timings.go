@@ -0,0 +1,48 @@
+package pngdiff
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Timings records how long each stage of handling a request took. It is safe
+// for concurrent use and a nil *Timings ignores everything.
+type Timings struct {
+	mu     sync.Mutex
+	stages []slog.Attr
+}
+
+// Record adds the duration of the named stage.
+func (t *Timings) Record(name string, d time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stages = append(t.stages, slog.Duration(name, d))
+}
+
+// Since records the time elapsed since start for the named stage.
+func (t *Timings) Since(name string, start time.Time) {
+	t.Record(name, time.Since(start))
+}
+
+// Attr groups every recorded stage for a log record.
+func (t *Timings) Attr() slog.Attr {
+	if t == nil {
+		return slog.Group("timings")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stages := make([]any, len(t.stages))
+	for i, stage := range t.stages {
+		stages[i] = stage
+	}
+
+	return slog.Group("timings", stages...)
+}
@@ -1,63 +1,81 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
-	"fmt"
-	"net/url"
-	"strconv"
+	"image/png"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/dewski/pngdiff/cmd/pngdiff"
 )
 
-func validURL(input string) bool {
-	if input == "" {
-		return false
-	}
-
-	_, err := url.Parse(input)
-	return err == nil
-}
+var logger = pngdiff.NewLambdaLogger()
 
-func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	minimumRegionArea := pngdiff.MinimumRegionArea
-	ra := request.QueryStringParameters["minimum_region_area"]
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (response events.APIGatewayProxyResponse, err error) {
+	start := time.Now()
+	requestID := pngdiff.RequestID(request.Headers, request.RequestContext.RequestID)
+	log := logger.With("request_id", requestID)
+	timings := &pngdiff.Timings{}
+	attrs := []any{}
 
-	if ra != "" {
-		var err error
-		minimumRegionArea, err = strconv.Atoi(ra)
+	defer func() {
 		if err != nil {
-			return events.APIGatewayProxyResponse{}, fmt.Errorf("invalid minimum_region_area must be an integer")
+			log.Error("request", append(attrs, "took", time.Since(start), "error", err.Error(), timings.Attr())...)
+			return
 		}
+
+		response.Headers[pngdiff.RequestIDHeader] = requestID
+		log.Info("request", append(attrs, "status", response.StatusCode, "took", time.Since(start), timings.Attr())...)
+	}()
+
+	opts, err := pngdiff.ParseOptions(request.QueryStringParameters)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
 	}
+	opts.Logger = log
+	opts.Timings = timings
 
-	imageURL := request.QueryStringParameters["image_url"]
-	if !validURL(imageURL) {
-		return events.APIGatewayProxyResponse{}, fmt.Errorf("missing valid image_url got \"%s\"", imageURL)
+	if err := opts.RequireImage(); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	attrs = append(attrs, "image_url", opts.ImageURL)
+	if opts.HasCompare() {
+		attrs = append(attrs, "compare_url", opts.CompareURL)
 	}
 
-	image, err := pngdiff.DownloadImage(imageURL)
+	image, compareImage, err := opts.LoadBoundsImages(ctx)
 	if err != nil {
-		return events.APIGatewayProxyResponse{}, fmt.Errorf("could not download %s", imageURL)
+		return events.APIGatewayProxyResponse{}, err
 	}
 
-	regions, err := pngdiff.DetectRegions(image)
+	regions, annotateImage, err := opts.DetectBounds(image, compareImage)
 	if err != nil {
 		return events.APIGatewayProxyResponse{}, err
 	}
+	attrs = append(attrs, "regions", len(regions))
 
-	filteredRegions := []*pngdiff.Region{}
-	for _, r := range regions {
-		if r.Area() < minimumRegionArea {
-			continue
+	if opts.Output != pngdiff.OutputJSON {
+		var buf bytes.Buffer
+		err = png.Encode(&buf, pngdiff.RenderRegions(annotateImage, regions, opts.Output))
+		if err != nil {
+			return events.APIGatewayProxyResponse{}, err
 		}
 
-		filteredRegions = append(filteredRegions, r)
+		return events.APIGatewayProxyResponse{
+			Body:            base64.StdEncoding.EncodeToString(buf.Bytes()),
+			IsBase64Encoded: true,
+			Headers: map[string]string{
+				"Content-Type": "image/png",
+			},
+			StatusCode: 200,
+		}, nil
 	}
 
-	json, err := json.Marshal(filteredRegions)
+	json, err := json.Marshal(regions)
 	if err != nil {
 		return events.APIGatewayProxyResponse{}, err
 	}
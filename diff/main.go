@@ -3,66 +3,68 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"net/url"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/dewski/pngdiff/cmd/pngdiff"
 )
 
-func validURL(input string) bool {
-	if input == "" {
-		return false
-	}
+var logger = pngdiff.NewLambdaLogger()
 
-	_, err := url.Parse(input)
-	return err == nil
-}
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (response events.APIGatewayProxyResponse, err error) {
+	start := time.Now()
+	requestID := pngdiff.RequestID(request.Headers, request.RequestContext.RequestID)
+	log := logger.With("request_id", requestID)
+	timings := &pngdiff.Timings{}
+	attrs := []any{}
 
-// Response handles the diff response.
-type Response struct {
-	Additions int     `json:"additions"`
-	Deletions int     `json:"deletions"`
-	Diffs     int     `json:"diffs"`
-	Changes   float64 `json:"changes"`
-}
+	defer func() {
+		if err != nil {
+			log.Error("request", append(attrs, "took", time.Since(start), "error", err.Error(), timings.Attr())...)
+			return
+		}
 
-func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	baseURL := request.QueryStringParameters["base_url"]
-	if !validURL(baseURL) {
-		return events.APIGatewayProxyResponse{}, fmt.Errorf("invalid base_url got %s", baseURL)
-	}
+		response.Headers[pngdiff.RequestIDHeader] = requestID
+		log.Info("request", append(attrs, "status", response.StatusCode, "took", time.Since(start), timings.Attr())...)
+	}()
 
-	compareURL := request.QueryStringParameters["compare_url"]
-	if !validURL(compareURL) {
-		return events.APIGatewayProxyResponse{}, fmt.Errorf("invalid compare_url got %s", compareURL)
+	opts, err := pngdiff.ParseOptions(request.QueryStringParameters)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
 	}
+	opts.Logger = log
+	opts.Timings = timings
 
-	baseImage, err := pngdiff.DownloadImage(baseURL)
-	if err != nil {
-		return events.APIGatewayProxyResponse{}, fmt.Errorf("could not download base_url at %s", baseURL)
+	if err := opts.RequirePair(); err != nil {
+		return events.APIGatewayProxyResponse{}, err
 	}
+	baseURL := opts.BaseURL
+	compareURL := opts.CompareURL
+	attrs = append(attrs, "base_url", baseURL, "compare_url", compareURL)
 
-	compareImage, err := pngdiff.DownloadImage(compareURL)
+	baseImage, compareImage, err := opts.LoadPair(ctx)
 	if err != nil {
-		return events.APIGatewayProxyResponse{}, fmt.Errorf("could not download compare_url at %s", compareURL)
+		return events.APIGatewayProxyResponse{}, err
 	}
 
+	diffStart := time.Now()
 	additions, deletions, diffs, changes, err := pngdiff.Diff(baseImage, compareImage)
+	timings.Since("diff", diffStart)
 
 	if err != nil {
 		return events.APIGatewayProxyResponse{}, err
 	}
+	attrs = append(attrs, "changes", changes)
 
-	response := Response{
+	result := pngdiff.Result{
 		Additions: additions,
 		Deletions: deletions,
 		Diffs:     diffs,
 		Changes:   changes,
 	}
 
-	json, err := json.Marshal(response)
+	json, err := json.Marshal(result)
 	if err != nil {
 		return events.APIGatewayProxyResponse{}, err
 	}
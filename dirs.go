@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dewski/pngdiff/cmd/pngdiff"
+)
+
+// Statuses of a file when comparing two directories.
+const (
+	fileAdded     = "added"
+	fileRemoved   = "removed"
+	fileChanged   = "changed"
+	fileUnchanged = "unchanged"
+	fileFailed    = "failed"
+)
+
+// dirFile is the outcome of comparing one relative path in both directories,
+// DiffImage is where its highlighted diff was written.
+type dirFile struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	*pngdiff.Result
+	DiffImage string `json:"diff_image,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	// Only set when the comparison is reported
+	report *reportPair
+}
+
+// dirReport counts the files in each status, Files is sorted by path.
+type dirReport struct {
+	Added     int        `json:"added"`
+	Removed   int        `json:"removed"`
+	Changed   int        `json:"changed"`
+	Unchanged int        `json:"unchanged"`
+	Failed    int        `json:"failed"`
+	Files     []*dirFile `json:"files"`
+}
+
+// isDir reports whether path is an existing directory.
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// listImages returns the slash separated paths of the PNGs under dir relative
+// to it.
+func listImages(dir string) (map[string]bool, error) {
+	images := map[string]bool{}
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(path), ".png") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		images[filepath.ToSlash(rel)] = true
+
+		return nil
+	})
+
+	return images, err
+}
+
+// dirComparison compares the PNGs in two directories.
+type dirComparison struct {
+	baseDir, compareDir string
+
+	// Diff images of changed pairs are written to the same relative path
+	// under out when it isn't empty.
+	out         string
+	parallelism int
+
+	// report keeps what writeReport needs for every file, detecting the
+	// regions which changed with the region and group options in opts.
+	report bool
+	opts   *pngdiff.Options
+}
+
+// run pairs the PNGs in both directories by relative path and diffs every
+// pair, up to parallelism at a time.
+func (c *dirComparison) run() (*dirReport, error) {
+	baseImages, err := listImages(c.baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	compareImages, err := listImages(c.compareDir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(baseImages)+len(compareImages))
+	for path := range baseImages {
+		paths = append(paths, path)
+	}
+	for path := range compareImages {
+		if !baseImages[path] {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	report := &dirReport{Files: make([]*dirFile, len(paths))}
+
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, c.parallelism)
+
+	for i, path := range paths {
+		file := &dirFile{Path: path}
+		report.Files[i] = file
+
+		switch {
+		case !compareImages[path]:
+			file.Status = fileRemoved
+		case !baseImages[path]:
+			file.Status = fileAdded
+		}
+
+		// Added and removed files only need loading for the report
+		if file.Status != "" && !c.report {
+			continue
+		}
+
+		wg.Add(1)
+		workers <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			if err := c.safeDiff(file); err != nil {
+				file.Status = fileFailed
+				file.Result = nil
+				file.Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, file := range report.Files {
+		switch file.Status {
+		case fileAdded:
+			report.Added++
+		case fileRemoved:
+			report.Removed++
+		case fileChanged:
+			report.Changed++
+		case fileUnchanged:
+			report.Unchanged++
+		case fileFailed:
+			report.Failed++
+		}
+	}
+
+	return report, nil
+}
+
+// load returns the file's image in dir, or nil when the file was added to or
+// removed from it.
+func (c *dirComparison) load(file *dirFile, dir, missing string) (image.Image, error) {
+	if file.Status == missing {
+		return nil, nil
+	}
+
+	path := filepath.Join(dir, filepath.FromSlash(file.Path))
+	img, err := pngdiff.DownloadImage(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %s: %s", path, err)
+	}
+
+	return img, nil
+}
+
+// diff diffs the file in both directories, setting its status unless it was
+// added or removed.
+func (c *dirComparison) diff(file *dirFile) error {
+	baseImage, err := c.load(file, c.baseDir, fileAdded)
+	if err != nil {
+		return err
+	}
+
+	compareImage, err := c.load(file, c.compareDir, fileRemoved)
+	if err != nil {
+		return err
+	}
+
+	if baseImage != nil && compareImage != nil {
+		additions, deletions, diffs, changes, err := pngdiff.Diff(baseImage, compareImage)
+		if err != nil {
+			return err
+		}
+		file.Result = &pngdiff.Result{
+			Additions: additions,
+			Deletions: deletions,
+			Diffs:     diffs,
+			Changes:   changes,
+		}
+		file.Status = resultStatus(file.Result)
+
+		if file.Status == fileChanged && c.out != "" {
+			if err := c.writeDiff(file, baseImage, compareImage); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.report {
+		file.report, err = newReportPair(baseImage, compareImage, c.opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// safeDiff diffs the file like diff, returning an error instead when diffing
+// panics so the other files are still compared.
+func (c *dirComparison) safeDiff(file *dirFile) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("diffing panicked: %v", v)
+		}
+	}()
+
+	return c.diff(file)
+}
+
+// writeDiff writes the diff image of a changed file under out.
+func (c *dirComparison) writeDiff(file *dirFile, baseImage, compareImage image.Image) error {
+	diffPath := filepath.Join(c.out, filepath.FromSlash(file.Path))
+	if err := os.MkdirAll(filepath.Dir(diffPath), 0755); err != nil {
+		return err
+	}
+
+	w, err := os.Create(diffPath)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if err := png.Encode(w, pngdiff.DiffImage(baseImage, compareImage)); err != nil {
+		return err
+	}
+	file.DiffImage = diffPath
+
+	return w.Close()
+}
+
+// reportPairs returns a reportPair for every file, including those which
+// failed before they could be rendered.
+func (r *dirReport) reportPairs() []*reportPair {
+	pairs := make([]*reportPair, len(r.Files))
+	for i, file := range r.Files {
+		pair := file.report
+		if pair == nil {
+			pair = &reportPair{}
+		}
+		pair.Name = file.Path
+		pair.Status = file.Status
+		pair.Result = file.Result
+		pair.Error = file.Error
+		pairs[i] = pair
+	}
+
+	return pairs
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePNG writes img to name under dir.
+func writePNG(t *testing.T, dir, name string, img image.Image) {
+	t.Helper()
+
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirComparisonPanics(t *testing.T) {
+	baseDir, compareDir := t.TempDir(), t.TempDir()
+
+	// Diff reads rows of compare past its height when base is taller
+	tall := image.NewNRGBA(image.Rect(0, 0, 4, 8))
+	draw.Draw(tall, image.Rect(0, 0, 4, 4), image.Black, image.Point{}, draw.Src)
+	short := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	opaque := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(opaque, opaque.Rect, image.Black, image.Point{}, draw.Src)
+
+	writePNG(t, baseDir, "mismatched.png", tall)
+	writePNG(t, compareDir, "mismatched.png", short)
+	writePNG(t, baseDir, "same.png", opaque)
+	writePNG(t, compareDir, "same.png", opaque)
+
+	comparison := &dirComparison{baseDir: baseDir, compareDir: compareDir, parallelism: 2}
+	report, err := comparison.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Failed != 1 || report.Unchanged != 1 {
+		t.Fatalf("%d failed and %d unchanged, want 1 of each", report.Failed, report.Unchanged)
+	}
+	if file := report.Files[0]; file.Path != "mismatched.png" || file.Status != fileFailed || file.Error == "" {
+		t.Errorf("%s is %s with error %q, want failed with an error", file.Path, file.Status, file.Error)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dewski/pngdiff/cmd/pngdiff"
+)
+
+// downloadTimeout bounds how long a request waits on its images, override it
+// with DOWNLOAD_TIMEOUT such as "45s".
+var downloadTimeout = 30 * time.Second
+
+func init() {
+	if timeout, err := time.ParseDuration(os.Getenv("DOWNLOAD_TIMEOUT")); err == nil && timeout > 0 {
+		downloadTimeout = timeout
+	}
+}
+
+// loadPair downloads the base and compare images at the same time.
+func loadPair(ctx context.Context, opts *pngdiff.Options) (baseImage, compareImage image.Image, err error) {
+	baseImage, compareImage, err = opts.LoadPair(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	recordImage(baseImage)
+	recordImage(compareImage)
+
+	return baseImage, compareImage, nil
+}
+
+// acquireDiff waits for the diffLimiter to allow diffing images, recording
+// the wait as the queue timing.
+func acquireDiff(ctx context.Context, opts *pngdiff.Options, images ...image.Image) (release func(), err error) {
+	start := time.Now()
+	release, err = diffLimiter.acquire(ctx, images...)
+	opts.Timings.Since("queue", start)
+
+	return
+}
+
+// diffPair downloads and diffs the base and compare images in opts.
+func diffPair(ctx context.Context, opts *pngdiff.Options) (*pngdiff.Result, error) {
+	downloadCtx, cancel := context.WithTimeout(ctx, downloadTimeout)
+	defer cancel()
+
+	baseImage, compareImage, err := loadPair(downloadCtx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffImages(ctx, opts, baseImage, compareImage)
+}
+
+// diffImages diffs the loaded base and compare images, returning the stored
+// result when the same pair was diffed before.
+func diffImages(ctx context.Context, opts *pngdiff.Options, baseImage, compareImage image.Image) (*pngdiff.Result, error) {
+	key, stored := storedResult(ctx, opts)
+	if stored != nil {
+		return stored, nil
+	}
+
+	release, err := acquireDiff(ctx, opts, baseImage, compareImage)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return runDiff(ctx, opts, key, baseImage, compareImage)
+}
+
+// storedResult returns the key the pair in opts is stored under, and its
+// result when the same pair was diffed before.
+func storedResult(ctx context.Context, opts *pngdiff.Options) (string, *pngdiff.Result) {
+	key := pngdiff.ResultKey(opts.ContentHash("base"), opts.ContentHash("compare"))
+	stored, ok, err := resultStore.Get(ctx, key)
+	if err != nil {
+		opts.Logger.Error("couldn't read stored result", "key", key, "error", err.Error())
+	}
+	if !ok {
+		return key, nil
+	}
+
+	stored.Cached = true
+	return key, stored
+}
+
+// runDiff diffs the images and stores the result under key, the caller must
+// hold the diffLimiter.
+func runDiff(ctx context.Context, opts *pngdiff.Options, key string, baseImage, compareImage image.Image) (*pngdiff.Result, error) {
+	start := time.Now()
+	additions, deletions, diffs, changes, err := pngdiff.Diff(baseImage, compareImage)
+	opts.Timings.Since("diff", start)
+
+	if err != nil {
+		return nil, err
+	}
+	recordDiff(time.Since(start), changes)
+
+	result := &pngdiff.Result{
+		Additions: additions,
+		Deletions: deletions,
+		Diffs:     diffs,
+		Changes:   changes,
+	}
+	if err := resultStore.Put(ctx, key, result); err != nil {
+		opts.Logger.Error("couldn't store result", "key", key, "error", err.Error())
+	}
+
+	return result, nil
+}
+
+func handleProcess(rw http.ResponseWriter, r *http.Request) {
+	log := logFor(r)
+
+	opts, err := parseRequest(rw, r)
+	if err == nil {
+		err = opts.RequirePair()
+	}
+	if err != nil {
+		renderError(rw, r, err)
+		return
+	}
+	log.Add("base_url", opts.BaseURL, "compare_url", opts.CompareURL)
+
+	result, err := diffPair(r.Context(), opts)
+	if err != nil {
+		renderError(rw, r, err)
+		return
+	}
+
+	log.Add("changes", result.Changes, "cached", result.Cached)
+	renderJSON(rw, http.StatusOK, result)
+}
+
+// detectBounds loads the images in opts and detects their bounds once the
+// diffLimiter allows it.
+func detectBounds(ctx context.Context, opts *pngdiff.Options) (regions []*pngdiff.Region, annotateImage image.Image, err error) {
+	downloadCtx, cancel := context.WithTimeout(ctx, downloadTimeout)
+	defer cancel()
+
+	img, compareImage, err := opts.LoadBoundsImages(downloadCtx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	images := []image.Image{img}
+	if compareImage != nil {
+		images = append(images, compareImage)
+	}
+	for _, loaded := range images {
+		recordImage(loaded)
+	}
+
+	release, err := acquireDiff(ctx, opts, images...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	return opts.DetectBounds(img, compareImage)
+}
+
+func handleBounds(rw http.ResponseWriter, r *http.Request) {
+	log := logFor(r)
+
+	opts, err := parseRequest(rw, r)
+	if err == nil {
+		err = opts.RequireImage()
+	}
+	if err != nil {
+		renderError(rw, r, err)
+		return
+	}
+	log.Add("image_url", opts.ImageURL)
+	if opts.HasCompare() {
+		log.Add("compare_url", opts.CompareURL)
+	}
+
+	regions, annotateImage, err := detectBounds(r.Context(), opts)
+	if err != nil {
+		renderError(rw, r, err)
+		return
+	}
+	log.Add("regions", len(regions))
+
+	if opts.Output != pngdiff.OutputJSON {
+		rw.Header().Set("Content-Type", "image/png")
+		png.Encode(rw, pngdiff.RenderRegions(annotateImage, regions, opts.Output))
+		return
+	}
+
+	renderJSON(rw, http.StatusOK, regions)
+}
+
+func handleLayoutDiff(rw http.ResponseWriter, r *http.Request) {
+	log := logFor(r)
+
+	opts, err := parseRequest(rw, r)
+	if err == nil {
+		err = opts.RequirePair()
+	}
+	if err != nil {
+		renderError(rw, r, err)
+		return
+	}
+	log.Add("base_url", opts.BaseURL, "compare_url", opts.CompareURL)
+
+	ctx, cancel := context.WithTimeout(r.Context(), downloadTimeout)
+	defer cancel()
+
+	baseImage, compareImage, err := loadPair(ctx, opts)
+	if err != nil {
+		renderError(rw, r, err)
+		return
+	}
+
+	release, err := acquireDiff(r.Context(), opts, baseImage, compareImage)
+	if err != nil {
+		renderError(rw, r, err)
+		return
+	}
+	defer release()
+
+	start := time.Now()
+	baseRegions, err := pngdiff.DetectRegions(baseImage, opts.Region)
+	if err != nil {
+		renderError(rw, r, err)
+		return
+	}
+
+	compareRegions, err := pngdiff.DetectRegions(compareImage, opts.Region)
+	if err != nil {
+		renderError(rw, r, err)
+		return
+	}
+
+	diff := pngdiff.DiffLayout(baseImage, compareImage, baseRegions, compareRegions)
+	opts.Timings.Since("diff", start)
+
+	log.Add("changes", len(diff.Changes))
+	renderJSON(rw, http.StatusOK, diff)
+}
+
+func handlePing(rw http.ResponseWriter, r *http.Request) {
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, "OK - %s", time.Now())
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newUpstream serves a PNG at /image.png, bytes which aren't a PNG at
+// /broken.png, a PNG after a delay at /slow.png, one twice as tall whose
+// bottom half is transparent at /tall.png and 404 for anything else.
+func newUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow.png":
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Second):
+			}
+			fallthrough
+		case "/image.png":
+			png.Encode(rw, image.NewNRGBA(image.Rect(0, 0, 4, 4)))
+		case "/tall.png":
+			tall := image.NewNRGBA(image.Rect(0, 0, 4, 8))
+			draw.Draw(tall, image.Rect(0, 0, 4, 4), image.Black, image.Point{}, draw.Src)
+			png.Encode(rw, tall)
+		case "/broken.png":
+			rw.Write([]byte("not a png"))
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	return upstream
+}
+
+// process requests /process with the query, returning the status and the
+// decoded error envelope.
+func process(t *testing.T, query url.Values) (int, errorResponse) {
+	t.Helper()
+
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/process?"+query.Encode(), nil)
+	withLogging("process", handleProcess)(rw, r)
+
+	if contentType := rw.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type is %q, want application/json", contentType)
+	}
+
+	var response errorResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &response); err != nil {
+		t.Fatalf("response isn't valid JSON: %s\n%s", err, rw.Body)
+	}
+
+	return rw.Code, response
+}
+
+func TestProcessErrors(t *testing.T) {
+	upstream := newUpstream(t)
+
+	timeout := downloadTimeout
+	downloadTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { downloadTimeout = timeout })
+
+	tests := []struct {
+		name     string
+		query    url.Values
+		status   int
+		code     string
+		param    string
+		upstream string
+	}{
+		{
+			name:   "invalid option",
+			query:  url.Values{"base_url": {upstream.URL + "/image.png"}, "compare_url": {upstream.URL + "/image.png"}, "connectivity": {"5"}},
+			status: http.StatusBadRequest,
+			code:   "invalid_input",
+			param:  "connectivity",
+		},
+		{
+			name:   "missing URL",
+			query:  url.Values{"compare_url": {upstream.URL + "/image.png"}},
+			status: http.StatusBadRequest,
+			code:   "invalid_input",
+			param:  "base_url",
+		},
+		{
+			name:   "undecodable PNG",
+			query:  url.Values{"base_url": {upstream.URL + "/image.png"}, "compare_url": {upstream.URL + "/broken.png"}},
+			status: http.StatusUnprocessableEntity,
+			code:   "undecodable_image",
+			param:  "compare_url",
+		},
+		{
+			name:     "upstream not found",
+			query:    url.Values{"base_url": {upstream.URL + "/missing.png"}, "compare_url": {upstream.URL + "/image.png"}},
+			status:   http.StatusBadGateway,
+			code:     "fetch_failed",
+			param:    "base_url",
+			upstream: "404",
+		},
+		{
+			name:   "fetch timeout",
+			query:  url.Values{"base_url": {upstream.URL + "/slow.png"}, "compare_url": {upstream.URL + "/image.png"}},
+			status: http.StatusGatewayTimeout,
+			code:   "fetch_timeout",
+			param:  "base_url",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, response := process(t, test.query)
+
+			if status != test.status {
+				t.Errorf("status is %d, want %d", status, test.status)
+			}
+			if response.Code != test.code {
+				t.Errorf("code is %q, want %q", response.Code, test.code)
+			}
+			if response.Message == "" {
+				t.Error("message is empty")
+			}
+			if param := response.Details["param"]; param != test.param {
+				t.Errorf("param is %q, want %q", param, test.param)
+			}
+			if upstream := response.Details["upstream_status"]; upstream != test.upstream {
+				t.Errorf("upstream_status is %q, want %q", upstream, test.upstream)
+			}
+		})
+	}
+}
+
+func TestProcessErrorWithQuote(t *testing.T) {
+	upstream := newUpstream(t)
+	missing := upstream.URL + `/"quoted".png`
+
+	status, response := process(t, url.Values{"base_url": {missing}, "compare_url": {upstream.URL + "/image.png"}})
+
+	if status != http.StatusBadGateway {
+		t.Errorf("status is %d, want %d", status, http.StatusBadGateway)
+	}
+	if !strings.Contains(response.Message, `"quoted"`) {
+		t.Errorf("message %q doesn't contain the quoted URL", response.Message)
+	}
+	if response.Details["url"] != missing {
+		t.Errorf("url is %q, want %q", response.Details["url"], missing)
+	}
+}
+
+func TestErrorStatusRetryAfter(t *testing.T) {
+	for _, err := range []error{errBusy, errQueueTimeout, errShuttingDown} {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/process", nil)
+		withLogging("process", func(rw http.ResponseWriter, r *http.Request) {
+			renderError(rw, r, err)
+		})(rw, r)
+
+		if rw.Header().Get("Retry-After") == "" {
+			t.Errorf("%s responded %d without Retry-After", err, rw.Code)
+		}
+	}
+}
+
+func TestProcessMalformedUpload(t *testing.T) {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/process", strings.NewReader("--wrong\r\n\r\nimage\r\n--wrong--\r\n"))
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=right")
+	withLogging("process", handleProcess)(rw, r)
+
+	var response errorResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &response); err != nil {
+		t.Fatalf("response isn't valid JSON: %s\n%s", err, rw.Body)
+	}
+
+	if rw.Code != http.StatusBadRequest || response.Code != "invalid_input" || response.Details["param"] != "body" {
+		t.Errorf("responded %d %s for %q, want 400 invalid_input for body", rw.Code, response.Code, response.Details["param"])
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dewski/pngdiff/cmd/pngdiff"
+)
+
+// Kinds of job /jobs accepts.
+const (
+	jobDiff   = "diff"
+	jobBounds = "bounds"
+)
+
+// Job statuses.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// Job settings, override them with JOB_WORKERS, JOB_QUEUE_SIZE, JOB_TIMEOUT
+// and JOB_TTL. Webhooks are only sent when WEBHOOK_SECRET is set to sign them.
+var (
+	jobWorkers   = envInt("JOB_WORKERS", 2)
+	jobQueueSize = envInt("JOB_QUEUE_SIZE", 100)
+	jobTimeout   = envDuration("JOB_TIMEOUT", 10*time.Minute)
+	jobTTL       = envDuration("JOB_TTL", time.Hour)
+
+	webhookSecret = os.Getenv("WEBHOOK_SECRET")
+)
+
+var (
+	// errJobNotFound is returned for unknown or expired job IDs.
+	errJobNotFound = errors.New("job not found")
+	// errShuttingDown is returned for jobs submitted after shutdown started.
+	errShuttingDown = errors.New("the server is shutting down")
+)
+
+// webhookSignatureHeader holds "sha256=" and the hex HMAC-SHA256 of the
+// webhook body keyed with WEBHOOK_SECRET.
+const webhookSignatureHeader = "X-Pngdiff-Signature"
+
+// asyncJob is a diff or bounds request run in the background.
+type asyncJob struct {
+	ID          string            `json:"id"`
+	Type        string            `json:"type"`
+	Status      string            `json:"status"`
+	Params      map[string]string `json:"params"`
+	CallbackURL string            `json:"callback_url,omitempty"`
+
+	// Result is the response /process or /bounds would have responded with
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *errorResponse  `json:"error,omitempty"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// jobStore keeps jobs while they run and after they finish so they can be
+// polled.
+type jobStore interface {
+	Create(ctx context.Context, job *asyncJob) error
+	// Get returns errJobNotFound when there is no job with the ID.
+	Get(ctx context.Context, id string) (*asyncJob, error)
+	Update(ctx context.Context, job *asyncJob) error
+}
+
+// memoryJobStore keeps jobs in memory, forgetting finished jobs after ttl.
+type memoryJobStore struct {
+	ttl time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]asyncJob
+}
+
+// newMemoryJobStore creates a store keeping finished jobs for ttl.
+func newMemoryJobStore(ttl time.Duration) *memoryJobStore {
+	return &memoryJobStore{ttl: ttl, jobs: map[string]asyncJob{}}
+}
+
+// Create stores the job, pruning expired jobs first.
+func (s *memoryJobStore) Create(ctx context.Context, job *asyncJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, stored := range s.jobs {
+		if stored.FinishedAt != nil && time.Since(*stored.FinishedAt) > s.ttl {
+			delete(s.jobs, id)
+		}
+	}
+
+	s.jobs[job.ID] = *job
+	return nil
+}
+
+// Get returns a copy of the job.
+func (s *memoryJobStore) Get(ctx context.Context, id string) (*asyncJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, errJobNotFound
+	}
+
+	return &job, nil
+}
+
+// Update replaces the stored job.
+func (s *memoryJobStore) Update(ctx context.Context, job *asyncJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.jobs[job.ID]; !ok {
+		return errJobNotFound
+	}
+
+	s.jobs[job.ID] = *job
+	return nil
+}
+
+// jobs runs submitted jobs on jobWorkers goroutines.
+var jobs = newJobRunner(newMemoryJobStore(jobTTL))
+
+type jobRunner struct {
+	store   jobStore
+	queue   chan *queuedJob
+	webhook *http.Client
+	start   sync.Once
+
+	// ctx is cancelled when shutdown gives up waiting, failing running jobs
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+
+	// webhooks are delivered apart from the workers so a slow callback
+	// doesn't hold up the queue
+	webhooks sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// queuedJob carries the logger of the request which submitted the job.
+type queuedJob struct {
+	id     string
+	logger *slog.Logger
+}
+
+func newJobRunner(store jobStore) *jobRunner {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &jobRunner{
+		store:   store,
+		queue:   make(chan *queuedJob, jobQueueSize),
+		webhook: &http.Client{Timeout: 10 * time.Second},
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// submit stores the job and queues it, returning errBusy when the queue is
+// full and errShuttingDown once shutdown started.
+func (j *jobRunner) submit(ctx context.Context, job *asyncJob, logger *slog.Logger) error {
+	j.start.Do(func() {
+		for i := int64(0); i < jobWorkers; i++ {
+			j.workers.Add(1)
+			go j.work()
+		}
+	})
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return errShuttingDown
+	}
+
+	if err := j.store.Create(ctx, job); err != nil {
+		return err
+	}
+
+	select {
+	case j.queue <- &queuedJob{id: job.ID, logger: logger.With("job_id", job.ID)}:
+		return nil
+	default:
+		j.finish(ctx, job, nil, errBusy)
+		return errBusy
+	}
+}
+
+// shutdown stops accepting jobs and waits for the queued and running jobs to
+// finish and their webhooks to be sent. Once ctx is done the jobs still
+// running are cancelled and fail, along with any still queued.
+func (j *jobRunner) shutdown(ctx context.Context) error {
+	j.mu.Lock()
+	if !j.closed {
+		j.closed = true
+		close(j.queue)
+	}
+	j.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		j.workers.Wait()
+		j.webhooks.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		j.cancel()
+		return ctx.Err()
+	}
+}
+
+func (j *jobRunner) work() {
+	defer j.workers.Done()
+
+	for queued := range j.queue {
+		j.run(queued)
+	}
+}
+
+func (j *jobRunner) run(queued *queuedJob) {
+	ctx, cancel := context.WithTimeout(j.ctx, jobTimeout)
+	defer cancel()
+
+	job, err := j.store.Get(ctx, queued.id)
+	if err != nil {
+		queued.logger.Error("couldn't load job", "error", err.Error())
+		return
+	}
+
+	start := time.Now()
+	job.Status = jobRunning
+	job.StartedAt = &start
+	if err := j.store.Update(ctx, job); err != nil {
+		queued.logger.Error("couldn't update job", "error", err.Error())
+	}
+
+	timings := &pngdiff.Timings{}
+	result, err := runJob(ctx, job, queued.logger, timings)
+	j.finish(ctx, job, result, err)
+
+	args := []any{"type", job.Type, "status", job.Status, "took", time.Since(start)}
+	if err != nil {
+		args = append(args, "error", err.Error())
+	}
+	queued.logger.Info("job", append(args, timings.Attr())...)
+
+	if job.CallbackURL != "" {
+		j.webhooks.Add(1)
+		go func() {
+			defer j.webhooks.Done()
+			j.notify(job, queued.logger)
+		}()
+	}
+}
+
+// runJob runs the job through the same path as /process or /bounds. A panic
+// fails the job, net/http only recovers those in handlers.
+func runJob(ctx context.Context, job *asyncJob, logger *slog.Logger, timings *pngdiff.Timings) (result interface{}, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			logger.Error("job panicked", "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			result, err = nil, fmt.Errorf("running the job panicked: %v", v)
+		}
+	}()
+
+	opts, err := pngdiff.ParseOptions(job.Params)
+	if err != nil {
+		return nil, err
+	}
+	opts.Logger = logger
+	opts.Timings = timings
+	opts.Cache = imageCache
+	opts.OnDownload = recordDownload
+
+	if job.Type == jobDiff {
+		return diffPair(ctx, opts)
+	}
+
+	regions, _, err := detectBounds(ctx, opts)
+	return regions, err
+}
+
+func (j *jobRunner) finish(ctx context.Context, job *asyncJob, result interface{}, err error) {
+	finished := time.Now()
+	job.FinishedAt = &finished
+
+	if err == nil {
+		job.Result, err = json.Marshal(result)
+	}
+
+	if err != nil {
+		_, response := newErrorResponse(err)
+		job.Status = jobFailed
+		job.Error = &response
+	} else {
+		job.Status = jobSucceeded
+	}
+
+	if err := j.store.Update(ctx, job); err != nil {
+		slog.Error("couldn't update job", "job_id", job.ID, "error", err.Error())
+	}
+}
+
+// signWebhook returns the signature header value for body.
+func signWebhook(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookTimeout bounds every attempt to deliver a webhook, it's separate
+// from jobTimeout so jobs which timed out still notify their callback.
+const webhookTimeout = time.Minute
+
+// notify posts the finished job to its callback URL, trying up to 3 times
+// while the receiver fails.
+func (j *jobRunner) notify(job *asyncJob, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(job)
+	if err != nil {
+		logger.Error("couldn't encode webhook", "error", err.Error())
+		return
+	}
+	signature := signWebhook(body)
+
+	const attempts = 3
+	backoff := time.Second
+	for attempt := 1; attempt <= attempts; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.CallbackURL, bytes.NewReader(body))
+		if err != nil {
+			logger.Error("couldn't send webhook", "error", err.Error())
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(webhookSignatureHeader, signature)
+
+		resp, err := j.webhook.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				logger.Info("sent webhook", "callback_url", job.CallbackURL, "status", resp.StatusCode, "attempt", attempt)
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		logger.Error("webhook failed", "callback_url", job.CallbackURL, "attempt", attempt, "error", err.Error())
+
+		if attempt == attempts {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 4
+	}
+}
+
+// jobRequest is the body POST /jobs accepts, Params holds the same
+// parameters as the /process or /bounds query string.
+type jobRequest struct {
+	Type        string     `json:"type"`
+	Params      jsonParams `json:"params"`
+	CallbackURL string     `json:"callback_url"`
+}
+
+// newJob validates the request the same way /process and /bounds would.
+func newJob(req *jobRequest) (*asyncJob, error) {
+	params := map[string]string{}
+	maps.Copy(params, req.Params)
+
+	opts, err := pngdiff.ParseOptions(params)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.Type {
+	case jobDiff:
+		err = opts.RequirePair()
+	case jobBounds:
+		err = opts.RequireImage()
+		if err == nil && opts.Output != pngdiff.OutputJSON {
+			err = &pngdiff.OptionError{Param: "output", Message: "must be json for jobs"}
+		}
+	default:
+		err = &pngdiff.OptionError{Param: "type", Message: "must be diff or bounds"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if req.CallbackURL != "" {
+		if webhookSecret == "" {
+			return nil, &pngdiff.OptionError{Param: "callback_url", Message: "isn't supported without a WEBHOOK_SECRET"}
+		}
+
+		callback, err := url.Parse(req.CallbackURL)
+		if err != nil || (callback.Scheme != "http" && callback.Scheme != "https") || callback.Host == "" {
+			return nil, &pngdiff.OptionError{Param: "callback_url", Message: "must be an http or https URL"}
+		}
+	}
+
+	return &asyncJob{
+		ID:          newRequestID(),
+		Type:        req.Type,
+		Status:      jobQueued,
+		Params:      params,
+		CallbackURL: req.CallbackURL,
+		CreatedAt:   time.Now(),
+	}, nil
+}
+
+// handleJobs submits jobs with POST /jobs and polls them with GET
+// /jobs/{id}.
+func handleJobs(rw http.ResponseWriter, r *http.Request) {
+	log := logFor(r)
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		var req jobRequest
+		r.Body = http.MaxBytesReader(rw, r.Body, maxUploadSize)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			if err = uploadError(err); !errors.Is(err, errUploadTooLarge) {
+				err = &pngdiff.OptionError{Param: "body", Message: "must be a JSON job"}
+			}
+			renderError(rw, r, err)
+			return
+		}
+
+		job, err := newJob(&req)
+		if err != nil {
+			renderError(rw, r, err)
+			return
+		}
+		log.Add("job_id", job.ID, "type", job.Type)
+
+		if err := jobs.submit(r.Context(), job, log.logger); err != nil {
+			renderError(rw, r, err)
+			return
+		}
+
+		rw.Header().Set("Location", "/jobs/"+job.ID)
+		renderJSON(rw, http.StatusAccepted, job)
+	case id != "" && r.Method == http.MethodGet:
+		log.Add("job_id", id)
+
+		job, err := jobs.store.Get(r.Context(), id)
+		if err != nil {
+			renderError(rw, r, err)
+			return
+		}
+
+		log.Add("status", job.Status)
+		renderJSON(rw, http.StatusOK, job)
+	default:
+		if id == "" {
+			rw.Header().Set("Allow", http.MethodPost)
+		} else {
+			rw.Header().Set("Allow", http.MethodGet)
+		}
+		renderError(rw, r, errMethodNotAllowed)
+	}
+}
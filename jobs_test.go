@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJobPanics(t *testing.T) {
+	upstream := newUpstream(t)
+	runner := newJobRunner(newMemoryJobStore(time.Hour))
+
+	// Diff reads rows of compare past its height when base is taller
+	job, err := newJob(&jobRequest{
+		Type:   jobDiff,
+		Params: jsonParams{"base_url": upstream.URL + "/tall.png", "compare_url": upstream.URL + "/image.png"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := runner.submit(ctx, job, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shutting down waits for the job to finish
+	if err := runner.shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err = runner.store.Get(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != jobFailed || job.Error == nil || job.Error.Code != "internal_error" {
+		t.Errorf("job is %s with error %+v, want failed with internal_error", job.Status, job.Error)
+	}
+}
+
+func TestJobWebhookDoesNotHoldWorker(t *testing.T) {
+	upstream := newUpstream(t)
+
+	release := make(chan struct{})
+	callback := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(callback.Close)
+
+	workers := jobWorkers
+	jobWorkers = 1
+	t.Cleanup(func() { jobWorkers = workers })
+
+	runner := newJobRunner(newMemoryJobStore(time.Hour))
+	ctx := context.Background()
+	t.Cleanup(func() {
+		close(release)
+		runner.shutdown(ctx)
+	})
+
+	// The first job's callback blocks until the second job finished
+	submitted := make([]*asyncJob, 2)
+	for i := range submitted {
+		job := &asyncJob{
+			ID:        newRequestID(),
+			Type:      jobDiff,
+			Status:    jobQueued,
+			Params:    map[string]string{"base_url": upstream.URL + "/image.png", "compare_url": upstream.URL + "/image.png"},
+			CreatedAt: time.Now(),
+		}
+		if i == 0 {
+			job.CallbackURL = callback.URL
+		}
+		if err := runner.submit(ctx, job, logger); err != nil {
+			t.Fatal(err)
+		}
+		submitted[i] = job
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		job, err := runner.store.Get(ctx, submitted[1].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status == jobSucceeded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("second job is still %s while the first job's webhook is sent", job.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
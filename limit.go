@@ -0,0 +1,174 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"image"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Errors returned when the server is too busy to diff, rendered with a
+// Retry-After header.
+var (
+	errBusy         = errors.New("too many requests are waiting to be diffed")
+	errQueueTimeout = errors.New("timed out waiting for other diffs to finish")
+)
+
+// Concurrency limits, override them with MAX_CONCURRENT_DIFFS, MAX_QUEUE and
+// QUEUE_TIMEOUT. Setting MAX_DIFF_MEGAPIXELS limits the total megapixels being
+// diffed at once instead of the number of diffs.
+var (
+	maxConcurrentDiffs = envInt("MAX_CONCURRENT_DIFFS", int64(runtime.NumCPU()))
+	maxDiffMegapixels  = envInt("MAX_DIFF_MEGAPIXELS", 0)
+	maxQueue           = envInt("MAX_QUEUE", 64)
+	queueTimeout       = envDuration("QUEUE_TIMEOUT", 10*time.Second)
+
+	// retryAfter is sent to clients turned away with 429 or 503
+	retryAfter = envDuration("RETRY_AFTER", 5*time.Second)
+)
+
+func envInt(name string, fallback int64) int64 {
+	if n, err := strconv.ParseInt(os.Getenv(name), 10, 64); err == nil && n > 0 {
+		return n
+	}
+
+	return fallback
+}
+
+// diffLimiter bounds the diffs and region detection running at once.
+var diffLimiter = newLimiter()
+
+func newLimiter() *limiter {
+	if maxDiffMegapixels > 0 {
+		return &limiter{capacity: maxDiffMegapixels, maxQueue: int(maxQueue), megapixels: true}
+	}
+
+	return &limiter{capacity: maxConcurrentDiffs, maxQueue: int(maxQueue)}
+}
+
+// limiter is a weighted semaphore which hands out capacity in the order it
+// was asked for.
+type limiter struct {
+	capacity int64
+	maxQueue int
+
+	// megapixels weighs each diff by the size of its images instead of 1
+	megapixels bool
+
+	mu      sync.Mutex
+	used    int64
+	waiters list.List
+}
+
+type waiter struct {
+	weight int64
+	ready  chan struct{}
+}
+
+// weight estimates how much of the capacity diffing images takes.
+func (l *limiter) weight(images ...image.Image) int64 {
+	if !l.megapixels {
+		return 1
+	}
+
+	var pixels int
+	for _, img := range images {
+		pixels += img.Bounds().Dx() * img.Bounds().Dy()
+	}
+
+	weight := int64(math.Ceil(float64(pixels) / 1e6))
+	if weight < 1 {
+		weight = 1
+	}
+	// Larger diffs still run, just on their own
+	if weight > l.capacity {
+		weight = l.capacity
+	}
+
+	return weight
+}
+
+// acquire waits up to queueTimeout for capacity to diff images, returning
+// errBusy straight away when the queue is full. Call the returned function
+// once the diff is done.
+func (l *limiter) acquire(ctx context.Context, images ...image.Image) (release func(), err error) {
+	weight := l.weight(images...)
+	release = func() {
+		l.release(weight)
+	}
+
+	l.mu.Lock()
+	if l.used+weight <= l.capacity && l.waiters.Len() == 0 {
+		l.used += weight
+		l.mu.Unlock()
+		return release, nil
+	}
+
+	if l.waiters.Len() >= l.maxQueue {
+		l.mu.Unlock()
+		return nil, errBusy
+	}
+
+	w := &waiter{weight: weight, ready: make(chan struct{})}
+	elem := l.waiters.PushBack(w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = errQueueTimeout
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		// Acquired while giving up, hand it back
+		l.used -= weight
+	default:
+		l.waiters.Remove(elem)
+	}
+	l.notify()
+
+	return nil, err
+}
+
+func (l *limiter) release(weight int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.used -= weight
+	l.notify()
+}
+
+// notify wakes waiters in order while their weight fits.
+func (l *limiter) notify() {
+	for {
+		front := l.waiters.Front()
+		if front == nil {
+			return
+		}
+
+		w := front.Value.(*waiter)
+		if l.used+w.weight > l.capacity {
+			return
+		}
+
+		l.used += w.weight
+		l.waiters.Remove(front)
+		close(w.ready)
+	}
+}
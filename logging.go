@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dewski/pngdiff/cmd/pngdiff"
+)
+
+// logger writes one record per request to stdout, set LOG_FORMAT=json for
+// JSON records instead of key=value text.
+var logger = newLogger(os.Getenv("LOG_FORMAT"))
+
+func newLogger(format string) *slog.Logger {
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	}
+
+	return slog.New(slog.NewTextHandler(os.Stdout, nil))
+}
+
+// requestIDHeader is read from requests and echoed on every response.
+const requestIDHeader = "X-Request-ID"
+
+// requestLog collects what a handler wants in the request's log record.
+type requestLog struct {
+	logger  *slog.Logger
+	timings *pngdiff.Timings
+
+	mu    sync.Mutex
+	attrs []any
+}
+
+// Add appends key/value pairs to the request's log record.
+func (l *requestLog) Add(args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.attrs = append(l.attrs, args...)
+}
+
+type requestLogKey struct{}
+
+// logFor returns the requestLog withLogging attached to the request.
+func logFor(r *http.Request) *requestLog {
+	if l, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		return l
+	}
+
+	return &requestLog{logger: logger}
+}
+
+// statusRecorder remembers the status written so it can be logged.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withLogging tags the request with an ID, taken from X-Request-ID when the
+// caller sent one, and logs a single record and its metrics once the handler
+// finishes. Metrics are labelled with endpoint rather than the path so IDs in
+// paths such as /jobs/{id} don't create a series each.
+func withLogging(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer trackInFlight(endpoint)()
+
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		rw.Header().Set(requestIDHeader, id)
+
+		l := &requestLog{
+			logger:  logger.With("request_id", id),
+			timings: &pngdiff.Timings{},
+		}
+		recorder := &statusRecorder{ResponseWriter: rw}
+
+		next(recorder, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, l)))
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		l.mu.Lock()
+		args := append([]any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"took", time.Since(start),
+		}, l.attrs...)
+		l.mu.Unlock()
+
+		level := slog.LevelInfo
+		if recorder.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		l.logger.Log(r.Context(), level, "request", append(args, l.timings.Attr())...)
+
+		recordRequest(endpoint, recorder.status, time.Since(start))
+	}
+}
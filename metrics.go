@@ -0,0 +1,92 @@
+package main
+
+import (
+	"image"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dewski/pngdiff/Godeps/_workspace/src/github.com/quipo/statsd"
+)
+
+// stats receives every metric the server emits, it's a no-op until
+// setupStatsd finds STATSD_ADDR.
+var stats statsd.Statsd = statsd.NoopClient{}
+
+// setupStatsd sends metrics to the statsd server at STATSD_ADDR such as
+// "localhost:8125", buffering them for STATSD_FLUSH_INTERVAL (default 1s).
+// Every metric is prefixed with STATSD_PREFIX (default "pngdiff.").
+func setupStatsd() error {
+	addr := os.Getenv("STATSD_ADDR")
+	if addr == "" {
+		return nil
+	}
+
+	prefix := os.Getenv("STATSD_PREFIX")
+	if prefix == "" {
+		prefix = "pngdiff."
+	}
+
+	interval := time.Second
+	if d, err := time.ParseDuration(os.Getenv("STATSD_FLUSH_INTERVAL")); err == nil && d > 0 {
+		interval = d
+	}
+
+	client := statsd.NewStatsdClient(addr, prefix)
+	if err := client.CreateSocket(); err != nil {
+		return err
+	}
+
+	buffer := statsd.NewStatsdBuffer(interval, client)
+	buffer.Verbose = false
+	stats = buffer
+
+	return nil
+}
+
+// histogram records a value which isn't a duration as a timer, the only
+// statsd type aggregated into min, max and average.
+func histogram(stat string, value float64) {
+	stats.PrecisionTiming(stat, time.Duration(value*float64(time.Millisecond)))
+}
+
+// The record functions update both statsd and the Prometheus metrics.
+
+// trackInFlight counts a request to endpoint as in flight until the returned
+// function is called.
+func trackInFlight(endpoint string) func() {
+	requestsInFlight.Add(1, endpoint)
+
+	return func() {
+		requestsInFlight.Add(-1, endpoint)
+	}
+}
+
+func recordRequest(endpoint string, status int, took time.Duration) {
+	stats.Incr("requests."+endpoint+"."+strconv.Itoa(status), 1)
+	stats.PrecisionTiming("requests."+endpoint+".time", took)
+
+	requestsTotal.Inc(endpoint, strconv.Itoa(status))
+	requestDuration.Observe(took.Seconds(), endpoint)
+}
+
+func recordDownload(url string, size int, took time.Duration) {
+	stats.Incr("download.count", 1)
+	stats.Incr("download.bytes", int64(size))
+	histogram("download.size", float64(size))
+	stats.PrecisionTiming("download.time", took)
+
+	downloadSize.Observe(float64(size))
+}
+
+func recordImage(img image.Image) {
+	bounds := img.Bounds()
+	histogram("image.megapixels", float64(bounds.Dx()*bounds.Dy())/1e6)
+}
+
+func recordDiff(took time.Duration, changes float64) {
+	stats.PrecisionTiming("diff.time", took)
+	histogram("diff.changes", changes)
+
+	diffChanges.Observe(changes)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dewski/pngdiff/Godeps/_workspace/src/github.com/quipo/statsd"
+)
+
+func TestStatsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv("STATSD_ADDR", conn.LocalAddr().String())
+	t.Setenv("STATSD_PREFIX", "test.")
+	t.Setenv("STATSD_FLUSH_INTERVAL", "10ms")
+
+	if err := setupStatsd(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stats.Close()
+		stats = statsd.NoopClient{}
+	})
+
+	recordRequest("process", 200, 15*time.Millisecond)
+	recordDownload("http://example.com/image.png", 2048, 5*time.Millisecond)
+
+	// Timers are aggregated into count, avg, min and max before sending
+	want := map[string]bool{
+		"test.requests.process.200:1|c":               false,
+		"test.requests.process.time.avg:15.000000|ms": false,
+		"test.download.count:1|c":                     false,
+		"test.download.bytes:2048|c":                  false,
+		"test.download.size.max:2048.000000|ms":       false,
+		"test.download.time.avg:5.000000|ms":          false,
+	}
+
+	// Read until every metric was flushed, they may arrive over several
+	// flushes
+	buf := make([]byte, 64<<10)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(missing(want)) > 0 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("%v weren't received: %v", missing(want), err)
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if _, ok := want[line]; ok {
+				want[line] = true
+			}
+		}
+	}
+}
+
+// missing returns the metrics which weren't received yet.
+func missing(metrics map[string]bool) (names []string) {
+	for metric, received := range metrics {
+		if !received {
+			names = append(names, metric)
+		}
+	}
+
+	return
+}
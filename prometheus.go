@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics scraped from /metrics in the Prometheus text format.
+var (
+	requestsTotal = newPromCounter("pngdiff_http_requests_total",
+		"Requests handled by endpoint and status.", "endpoint", "status")
+	requestDuration = newPromHistogram("pngdiff_http_request_duration_seconds",
+		"Time taken to respond by endpoint.",
+		[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "endpoint")
+	requestsInFlight = newPromGauge("pngdiff_http_requests_in_flight",
+		"Requests currently being handled by endpoint.", "endpoint")
+	downloadSize = newPromHistogram("pngdiff_download_size_bytes",
+		"Size of downloaded images.",
+		[]float64{16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20})
+	diffChanges = newPromHistogram("pngdiff_diff_changes_percent",
+		"Percentage of pixels changed between two images.",
+		[]float64{0, 0.1, 1, 5, 10, 25, 50, 75, 100})
+)
+
+var promMetrics = []promMetric{
+	requestsTotal,
+	requestDuration,
+	requestsInFlight,
+	downloadSize,
+	diffChanges,
+}
+
+type promMetric interface {
+	write(w io.Writer)
+}
+
+// promLabels escapes label values for the text format.
+var promLabels = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders names and values as {name="value",...}, extra is
+// appended unescaped such as the le label of histogram buckets.
+func formatLabels(names, values []string, extra string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+promLabels.Replace(values[i])+`"`)
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// seriesKey joins label values to key a series.
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// sortedKeys returns the series keys in a stable order for scraping.
+func sortedKeys(series map[string][]string) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// promValues is a counter or gauge, one value per set of label values.
+type promValues struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	series map[string][]string
+	values map[string]float64
+}
+
+type promCounter struct{ *promValues }
+
+type promGauge struct{ *promValues }
+
+func newPromValues(name, help, kind string, labels []string) *promValues {
+	return &promValues{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: map[string][]string{},
+		values: map[string]float64{},
+	}
+}
+
+func newPromCounter(name, help string, labels ...string) promCounter {
+	return promCounter{newPromValues(name, help, "counter", labels)}
+}
+
+func newPromGauge(name, help string, labels ...string) promGauge {
+	return promGauge{newPromValues(name, help, "gauge", labels)}
+}
+
+func (m *promValues) add(delta float64, values ...string) {
+	key := seriesKey(values)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.series[key] = values
+	m.values[key] += delta
+}
+
+// Inc adds one to the counter.
+func (c promCounter) Inc(values ...string) {
+	c.add(1, values...)
+}
+
+// Add moves the gauge by delta.
+func (g promGauge) Add(delta float64, values ...string) {
+	g.add(delta, values...)
+}
+
+func (m *promValues) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, m.name, m.help, m.kind)
+	for _, key := range sortedKeys(m.series) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, m.series[key], ""), formatFloat(m.values[key]))
+	}
+}
+
+// promHistogram counts observations into cumulative buckets.
+type promHistogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string][]string
+	counts map[string][]uint64
+	sums   map[string]float64
+	totals map[string]uint64
+}
+
+func newPromHistogram(name, help string, buckets []float64, labels ...string) *promHistogram {
+	h := &promHistogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string][]string{},
+		counts:  map[string][]uint64{},
+		sums:    map[string]float64{},
+		totals:  map[string]uint64{},
+	}
+
+	// Without labels there's a single series, scrape it before any observations
+	if len(labels) == 0 {
+		h.series[""] = nil
+		h.counts[""] = make([]uint64, len(buckets))
+	}
+
+	return h
+}
+
+// Observe records v in every bucket it fits.
+func (h *promHistogram) Observe(v float64, values ...string) {
+	key := seriesKey(values)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	counts, ok := h.counts[key]
+	if !ok {
+		counts = make([]uint64, len(h.buckets))
+		h.counts[key] = counts
+		h.series[key] = values
+	}
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			counts[i]++
+		}
+	}
+	h.sums[key] += v
+	h.totals[key]++
+}
+
+func (h *promHistogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		values := h.series[key]
+
+		for i, bound := range h.buckets {
+			le := `le="` + formatFloat(bound) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, le), h.counts[key][i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, `le="+Inf"`), h.totals[key])
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values, ""), formatFloat(h.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values, ""), h.totals[key])
+	}
+}
+
+// writeRuntimeMetrics reports the Go runtime's memory and scheduler state.
+func writeRuntimeMetrics(w io.Writer) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	metrics := []struct {
+		name, help, kind string
+		value            float64
+	}{
+		{"go_goroutines", "Number of goroutines that currently exist.", "gauge", float64(runtime.NumGoroutine())},
+		{"go_memstats_alloc_bytes", "Bytes allocated and still in use.", "gauge", float64(mem.Alloc)},
+		{"go_memstats_alloc_bytes_total", "Bytes allocated, even if freed.", "counter", float64(mem.TotalAlloc)},
+		{"go_memstats_sys_bytes", "Bytes obtained from the system.", "gauge", float64(mem.Sys)},
+		{"go_memstats_heap_inuse_bytes", "Heap bytes in use.", "gauge", float64(mem.HeapInuse)},
+		{"go_memstats_heap_idle_bytes", "Heap bytes waiting to be used.", "gauge", float64(mem.HeapIdle)},
+		{"go_memstats_heap_objects", "Number of allocated objects.", "gauge", float64(mem.HeapObjects)},
+		{"go_memstats_next_gc_bytes", "Heap size when the next garbage collection will run.", "gauge", float64(mem.NextGC)},
+		{"go_gc_cycles_total", "Completed garbage collection cycles.", "counter", float64(mem.NumGC)},
+		{"go_gc_pause_seconds_total", "Time spent paused for garbage collection.", "counter", float64(mem.PauseTotalNs) / 1e9},
+	}
+
+	for _, m := range metrics {
+		writeHeader(w, m.name, m.help, m.kind)
+		fmt.Fprintf(w, "%s %s\n", m.name, formatFloat(m.value))
+	}
+}
+
+func handleMetrics(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	for _, m := range promMetrics {
+		m.write(rw)
+	}
+	writeRuntimeMetrics(rw)
+}
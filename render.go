@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/dewski/pngdiff/cmd/pngdiff"
+)
+
+// errMethodNotAllowed is returned for methods an endpoint doesn't handle.
+var errMethodNotAllowed = errors.New("method not allowed")
+
+// errorResponse is the JSON envelope for every error the server returns.
+type errorResponse struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func renderJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+// errorStatus maps an error to the HTTP status and error code it's rendered
+// with.
+func errorStatus(err error) (status int, code string) {
+	var optionErr *pngdiff.OptionError
+	var fetchErr *pngdiff.FetchError
+
+	switch {
+	case errors.Is(err, errJobNotFound):
+		return http.StatusNotFound, "not_found"
+	case errors.Is(err, errMethodNotAllowed):
+		return http.StatusMethodNotAllowed, "method_not_allowed"
+	case errors.Is(err, errBusy):
+		return http.StatusTooManyRequests, "busy"
+	case errors.Is(err, errQueueTimeout):
+		return http.StatusServiceUnavailable, "queue_timeout"
+	case errors.Is(err, errShuttingDown):
+		return http.StatusServiceUnavailable, "shutting_down"
+	case errors.Is(err, errUploadTooLarge):
+		return http.StatusRequestEntityTooLarge, "upload_too_large"
+	case errors.As(err, &optionErr):
+		return http.StatusBadRequest, "invalid_input"
+	case errors.Is(err, pngdiff.ErrDecode):
+		return http.StatusUnprocessableEntity, "undecodable_image"
+	case errors.As(err, &fetchErr) && fetchErr.Timeout():
+		return http.StatusGatewayTimeout, "fetch_timeout"
+	case errors.As(err, &fetchErr):
+		return http.StatusBadGateway, "fetch_failed"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "timeout"
+	default:
+		return http.StatusInternalServerError, "internal_error"
+	}
+}
+
+// renderError responds with the error envelope for err and adds it to the
+// request's log record.
+func renderError(rw http.ResponseWriter, r *http.Request, err error) {
+	logFor(r).Add("error", err.Error())
+
+	status, response := newErrorResponse(err)
+
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+
+	renderJSON(rw, status, response)
+}
+
+// newErrorResponse builds the error envelope for err and the status it's
+// rendered with.
+func newErrorResponse(err error) (int, errorResponse) {
+	status, code := errorStatus(err)
+	response := errorResponse{
+		Code:    code,
+		Message: err.Error(),
+		Details: map[string]string{},
+	}
+
+	var optionErr *pngdiff.OptionError
+	var imageErr *pngdiff.ImageError
+	var fetchErr *pngdiff.FetchError
+
+	if errors.As(err, &optionErr) {
+		response.Details["param"] = optionErr.Param
+	} else if errors.As(err, &imageErr) {
+		response.Details["param"] = imageErr.Param
+	}
+
+	if errors.As(err, &fetchErr) {
+		response.Details["url"] = fetchErr.URL
+		if fetchErr.StatusCode != 0 {
+			response.Details["upstream_status"] = strconv.Itoa(fetchErr.StatusCode)
+		}
+	}
+
+	return status, response
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/dewski/pngdiff/cmd/pngdiff"
+)
+
+// reportPair is a pair of images shown in an HTML report. Base, Compare and
+// Diff are PNG data URIs, empty when the pair is missing that image.
+type reportPair struct {
+	Name   string
+	Status string
+	Result *pngdiff.Result
+	Error  string
+
+	Base, Compare, Diff   template.URL
+	BaseSize, CompareSize image.Point
+
+	// Size of the canvas both images are drawn on, the regions which changed
+	// are positioned on it.
+	Size    image.Point
+	Regions []*pngdiff.Region
+}
+
+// resultStatus reports whether a Diff found any changed pixels.
+func resultStatus(result *pngdiff.Result) string {
+	if result.Additions+result.Deletions+result.Diffs == 0 {
+		return fileUnchanged
+	}
+
+	return fileChanged
+}
+
+// newReportPair renders the images of a pair for a report, either image may
+// be nil for files which were added or removed. Regions are only detected
+// when there are both images, with the region and group options in opts.
+func newReportPair(baseImage, compareImage image.Image, opts *pngdiff.Options) (*reportPair, error) {
+	pair := &reportPair{}
+
+	var err error
+	if baseImage != nil {
+		pair.BaseSize = baseImage.Bounds().Size()
+		if pair.Base, err = dataURI(baseImage); err != nil {
+			return nil, err
+		}
+	}
+
+	if compareImage != nil {
+		pair.CompareSize = compareImage.Bounds().Size()
+		if pair.Compare, err = dataURI(compareImage); err != nil {
+			return nil, err
+		}
+	}
+
+	pair.Size = image.Rectangle{Max: pair.BaseSize}.Union(image.Rectangle{Max: pair.CompareSize}).Max
+	if baseImage == nil || compareImage == nil {
+		return pair, nil
+	}
+
+	if pair.Diff, err = dataURI(pngdiff.DiffImage(baseImage, compareImage)); err != nil {
+		return nil, err
+	}
+
+	regions, err := pngdiff.DetectChanges(baseImage, compareImage, opts.Region)
+	if err != nil {
+		return nil, err
+	}
+	pair.Regions = pngdiff.GroupRegions(regions, opts.Group)
+
+	return pair, nil
+}
+
+func dataURI(img image.Image) (template.URL, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+func (p *reportPair) changes() float64 {
+	if p.Result == nil {
+		return 0
+	}
+
+	return p.Result.Changes
+}
+
+// reportStatuses is the order statuses are counted in a report's summary.
+var reportStatuses = []string{fileFailed, fileChanged, fileAdded, fileRemoved, fileUnchanged}
+
+// writeReport writes a self-contained HTML page showing every pair, the pairs
+// which failed first and then the most changed.
+func writeReport(w io.Writer, title string, pairs []*reportPair) error {
+	sort.SliceStable(pairs, func(i, j int) bool {
+		if failedI, failedJ := pairs[i].Status == fileFailed, pairs[j].Status == fileFailed; failedI != failedJ {
+			return failedI
+		}
+
+		return pairs[i].changes() > pairs[j].changes()
+	})
+
+	counts := map[string]int{}
+	for _, pair := range pairs {
+		counts[pair.Status]++
+	}
+
+	type statusCount struct {
+		Status string
+		Count  int
+	}
+	var summary []statusCount
+	for _, status := range reportStatuses {
+		if counts[status] > 0 {
+			summary = append(summary, statusCount{status, counts[status]})
+		}
+	}
+
+	return reportTemplate.Execute(w, map[string]interface{}{
+		"Title":   title,
+		"Summary": summary,
+		"Pairs":   pairs,
+	})
+}
+
+// percent positions n pixels on a canvas total pixels wide or tall.
+func percent(n, total int) string {
+	if total == 0 {
+		return "0%"
+	}
+
+	return fmt.Sprintf("%.4f%%", float64(n)*100/float64(total))
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": percent,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font: 14px/1.4 -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #24292f; }
+.summary span { margin-right: 1em; }
+.pair { border-top: 1px solid #d0d7de; padding: 1em 0; }
+.pair h2 { font-size: 16px; word-break: break-all; }
+.status { font-size: 12px; font-weight: normal; padding: 2px 6px; border-radius: 4px; background: #eaeef2; }
+.failed .status, .error { color: #cf222e; }
+.images { display: flex; flex-wrap: wrap; gap: 1em; align-items: flex-start; }
+figure { margin: 0; flex: 1 1 300px; }
+figure img { max-width: 100%; background: repeating-conic-gradient(#eee 0 25%, #fff 0 50%) 0 0 / 16px 16px; }
+.viewer { position: relative; width: 100%; }
+.viewer img { position: absolute; top: 0; left: 0; }
+.swipe .compare { clip-path: inset(0 calc(100% - var(--position, 50%)) 0 0); }
+.onion .compare { opacity: var(--position, 50%); }
+.region { position: absolute; box-sizing: border-box; border: 2px solid #bf8700; pointer-events: none; }
+.region.added { border-color: #1a7f37; }
+.region.removed { border-color: #cf222e; }
+.region.modified { border-color: #d300d3; }
+.controls input[type=range] { width: 100%; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="summary">{{range .Summary}}<span>{{.Count}} {{.Status}}</span>{{end}}</p>
+{{range $i, $pair := .Pairs}}
+<section class="pair {{.Status}}">
+<h2>{{.Name}} <span class="status">{{.Status}}</span></h2>
+{{with .Error}}<p class="error">{{.}}</p>{{end}}
+{{with .Result}}<p>{{printf "%.2f" .Changes}}% changed, {{.Additions}} pixels added, {{.Deletions}} removed and {{.Diffs}} different</p>{{end}}
+<div class="images">
+{{if and .Base .Compare}}
+<figure>
+<figcaption class="controls">
+<label><input type="radio" name="mode-{{$i}}" value="swipe" checked> Swipe</label>
+<label><input type="radio" name="mode-{{$i}}" value="onion"> Onion skin</label>
+<input type="range" min="0" max="100" value="50" aria-label="Base to compare">
+</figcaption>
+<div class="viewer swipe" style="aspect-ratio: {{.Size.X}} / {{.Size.Y}}; max-width: {{.Size.X}}px">
+<img class="base" src="{{.Base}}" alt="Base" style="width: {{percent .BaseSize.X .Size.X}}">
+<img class="compare" src="{{.Compare}}" alt="Compare" style="width: {{percent .CompareSize.X .Size.X}}">
+{{range .Regions}}<div class="region {{.Change}}" title="{{.Change}}, {{.Pixels}} pixels" style="left: {{percent .X1 $pair.Size.X}}; top: {{percent .Y1 $pair.Size.Y}}; width: {{percent .Width $pair.Size.X}}; height: {{percent .Height $pair.Size.Y}}"></div>
+{{end}}
+</div>
+</figure>
+<figure><figcaption>Diff</figcaption><img src="{{.Diff}}" alt="Diff"></figure>
+{{else}}
+{{with .Base}}<figure><figcaption>Base</figcaption><img src="{{.}}" alt="Base"></figure>{{end}}
+{{with .Compare}}<figure><figcaption>Compare</figcaption><img src="{{.}}" alt="Compare"></figure>{{end}}
+{{end}}
+</div>
+</section>
+{{end}}
+<script>
+document.querySelectorAll(".pair").forEach(function (pair) {
+  var viewer = pair.querySelector(".viewer");
+  if (!viewer) return;
+
+  var update = function () {
+    viewer.className = "viewer " + pair.querySelector("input[type=radio]:checked").value;
+    viewer.style.setProperty("--position", pair.querySelector("input[type=range]").value + "%");
+  };
+  pair.querySelectorAll("input").forEach(function (input) {
+    input.addEventListener("input", update);
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+// writeReportFile writes the report to path.
+func writeReportFile(path, title string, pairs []*reportPair) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := writeReport(file, title, pairs); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+
+	"github.com/dewski/pngdiff/cmd/pngdiff"
+)
+
+// resultStore memoizes /process results, kept as files in RESULT_STORE_DIR
+// when it's set or in memory for the last RESULT_STORE_SIZE (default 10000)
+// pairs otherwise.
+var resultStore = newResultStore()
+
+func newResultStore() pngdiff.ResultStore {
+	if dir := os.Getenv("RESULT_STORE_DIR"); dir != "" {
+		return &pngdiff.FileResultStore{Dir: dir}
+	}
+
+	return pngdiff.NewMemoryResultStore(int(envInt("RESULT_STORE_SIZE", 10000)))
+}
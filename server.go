@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Server timeouts, override them with READ_HEADER_TIMEOUT, WRITE_TIMEOUT,
+// IDLE_TIMEOUT, SHUTDOWN_DELAY and SHUTDOWN_TIMEOUT such as "45s". Writes must
+// allow for the images to download so WRITE_TIMEOUT should stay above
+// DOWNLOAD_TIMEOUT.
+var (
+	readHeaderTimeout = envDuration("READ_HEADER_TIMEOUT", 10*time.Second)
+	writeTimeout      = envDuration("WRITE_TIMEOUT", 2*time.Minute)
+	idleTimeout       = envDuration("IDLE_TIMEOUT", 2*time.Minute)
+
+	// shutdownDelay keeps serving after /_ready fails so load balancers stop
+	// sending requests before the listener closes.
+	shutdownDelay   = envDuration("SHUTDOWN_DELAY", 5*time.Second)
+	shutdownTimeout = envDuration("SHUTDOWN_TIMEOUT", 20*time.Second)
+)
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d > 0 {
+		return d
+	}
+
+	return fallback
+}
+
+// ready is cleared once the server starts shutting down so /_ready takes it
+// out of rotation while in-flight requests drain.
+var ready atomic.Bool
+
+func handleReady(rw http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(rw, "shutting down")
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, "OK - %s", time.Now())
+}
+
+// serve runs the server until SIGTERM or SIGINT, then fails /_ready for
+// shutdownDelay before it stops accepting connections and waits up to
+// shutdownTimeout for in-flight requests and background jobs.
+func serve(server *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	ready.Store(true)
+	logger.Info("listening", "addr", server.Addr)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	ready.Store(false)
+	logger.Info("shutting down", "delay", shutdownDelay, "timeout", shutdownTimeout)
+	time.Sleep(shutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		server.Close()
+	}
+
+	// Background jobs get whatever is left of the same timeout
+	if jobErr := jobs.shutdown(shutdownCtx); jobErr != nil {
+		logger.Error("jobs didn't finish before shutting down", "error", jobErr.Error())
+	}
+
+	// Flush any buffered metrics
+	stats.Close()
+
+	return err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dewski/pngdiff/cmd/pngdiff"
+)
+
+// maxUploadSize is the largest request body accepted in bytes, override it
+// with MAX_UPLOAD_SIZE.
+var maxUploadSize int64 = 32 << 20
+
+func init() {
+	if size, err := strconv.ParseInt(os.Getenv("MAX_UPLOAD_SIZE"), 10, 64); err == nil && size > 0 {
+		maxUploadSize = size
+	}
+}
+
+// imageCache keeps up to IMAGE_CACHE_SIZE bytes (default 256MB) of decoded
+// images so baselines compared against many times are only downloaded and
+// decoded once. Set it to 0 to disable the cache.
+var imageCache *pngdiff.ImageCache
+
+func init() {
+	size := int64(256 << 20)
+	if s, err := strconv.ParseInt(os.Getenv("IMAGE_CACHE_SIZE"), 10, 64); err == nil && s >= 0 {
+		size = s
+	}
+
+	if size > 0 {
+		imageCache = pngdiff.NewImageCache(size)
+	}
+}
+
+// errUploadTooLarge is returned when the request body exceeds maxUploadSize.
+var errUploadTooLarge = errors.New("upload is larger than the maximum allowed size")
+
+// Multipart form fields holding uploaded images.
+var uploadFields = []string{"image", "base", "compare"}
+
+// parseRequest reads Options from the query string, or the form fields of a
+// multipart upload. Uploaded images in the image, base and compare fields are
+// used instead of image_url, base_url and compare_url. A raw image/png body is
+// treated as the image field.
+func parseRequest(rw http.ResponseWriter, r *http.Request) (*pngdiff.Options, error) {
+	log := logFor(r)
+	values := r.URL.Query()
+	uploads := map[string][]byte{}
+
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(rw, r.Body, maxUploadSize)
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+		switch contentType {
+		case "multipart/form-data":
+			if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+				return nil, uploadError(err)
+			}
+			values = r.Form
+
+			for _, field := range uploadFields {
+				file, _, err := r.FormFile(field)
+				if err == http.ErrMissingFile {
+					continue
+				}
+				if err != nil {
+					return nil, uploadError(err)
+				}
+
+				body, err := ioutil.ReadAll(file)
+				file.Close()
+				if err != nil {
+					return nil, uploadError(err)
+				}
+				uploads[field] = body
+			}
+		case "image/png":
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return nil, uploadError(err)
+			}
+			uploads["image"] = body
+		}
+	}
+
+	opts, err := pngdiff.ParseQuery(values)
+	if err != nil {
+		return nil, err
+	}
+
+	images := map[string]*image.Image{
+		"image":   &opts.Image,
+		"base":    &opts.BaseImage,
+		"compare": &opts.CompareImage,
+	}
+	for _, field := range uploadFields {
+		body, ok := uploads[field]
+		if !ok {
+			continue
+		}
+
+		start := time.Now()
+		img, err := pngdiff.DecodeImage(bytes.NewReader(body))
+		log.timings.Since("decode_"+field, start)
+		if err != nil {
+			return nil, &pngdiff.ImageError{Param: field, Err: err}
+		}
+
+		*images[field] = img
+		opts.SetContentHash(field, body)
+	}
+
+	opts.Logger = log.logger
+	opts.Timings = log.timings
+	opts.Cache = imageCache
+	opts.OnDownload = recordDownload
+
+	return opts, nil
+}
+
+// uploadError maps an error reading the request body to errUploadTooLarge,
+// or an invalid body since anything else is the client's malformed input.
+func uploadError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errUploadTooLarge
+	}
+
+	return &pngdiff.OptionError{Param: "body", Message: "couldn't be read: " + err.Error()}
+}